@@ -0,0 +1,105 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// ErrEmptyResponse is returned when the provider answers without any choices
+var ErrEmptyResponse = errors.New("empty response from AI provider")
+
+// NewClient builds a client for the configured provider and returns it with the default model
+func NewClient() (*openai.Client, string) {
+	var config openai.ClientConfig
+	var model string
+
+	if registry.Config.AiProvider == "openrouter" {
+		config = openai.DefaultConfig(registry.Config.OpenrouterApiKey)
+		config.BaseURL = "https://openrouter.ai/api/v1"
+		model = registry.Config.AiModel
+	} else {
+		config = openai.DefaultConfig(registry.Config.OpenaiApiKey)
+		model = "gpt-4o-mini"
+	}
+
+	// Allows pointing the bot at any OpenAI-compatible server
+	if registry.Config.AiBaseURL != "" {
+		config.BaseURL = registry.Config.AiBaseURL
+	}
+
+	return openai.NewClientWithConfig(config), model
+}
+
+// SupportsVision reports whether the model accepts images
+func SupportsVision(model string) bool {
+	if model == "" {
+		_, model = NewClient()
+	}
+
+	for _, visionModel := range registry.Config.AiVisionModels {
+		if visionModel == model {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateChatCompletion sends the request to the configured provider,
+// filling in the default model when none is set. The call is checked
+// against the budgets and its usage is recorded.
+func CreateChatCompletion(ctx context.Context, call Call, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	client, model := NewClient()
+
+	if req.Model == "" {
+		req.Model = model
+	}
+
+	if err := checkBudget(call); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+
+	started := time.Now()
+	resp, err := client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	recordUsage(call, req.Model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, time.Since(started))
+
+	if len(resp.Choices) == 0 {
+		return resp, ErrEmptyResponse
+	}
+
+	return resp, nil
+}
+
+// Ask sends a single system and user prompt pair and returns the reply text
+func Ask(ctx context.Context, call Call, system string, user string) (string, error) {
+	resp, err := CreateChatCompletion(ctx, call, openai.ChatCompletionRequest{
+		Temperature: 0.3,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: system,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: user,
+			},
+		},
+	})
+
+	if err != nil {
+		log.Printf("AI: completion error: %v", err)
+		return "", err
+	}
+
+	return resp.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,106 @@
+package ai
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// CacheKey hashes the parts identifying an AI request,
+// the first part is the question and is normalized
+func CacheKey(question string, parts ...string) string {
+	hash := sha256.New()
+	hash.Write([]byte(normalizeQuestion(question)))
+
+	for _, part := range parts {
+		hash.Write([]byte{0})
+		hash.Write([]byte(part))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// HashText is a short fingerprint of a long context such as the chat history
+func HashText(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeQuestion ignores case, extra spaces and trailing punctuation
+func normalizeQuestion(question string) string {
+	question = strings.Join(strings.Fields(strings.ToLower(question)), " ")
+	return strings.TrimRight(question, "?!.… ")
+}
+
+// CachedResponse returns a fresh cached reply and counts the hit or miss
+func CachedResponse(key string) (string, bool) {
+	config := registry.Config.AiCache
+	if !config.Enabled {
+		return "", false
+	}
+
+	var response string
+	err := database.DB.QueryRow(
+		"SELECT response FROM ai_cache WHERE key = ? AND unixtime >= ?",
+		key, time.Now().Add(-cacheTTL()).Unix()).Scan(&response)
+
+	if err != nil {
+		countCache("misses")
+		return "", false
+	}
+
+	countCache("hits")
+
+	_, err = database.DB.Exec("UPDATE ai_cache SET hits = hits + 1 WHERE key = ?", key)
+	if err != nil {
+		log.Printf("AI: error updating cache hits: %v", err)
+	}
+
+	log.Printf("AI: cache hit %v", key[:12])
+
+	return response, true
+}
+
+// CacheResponse saves the reply and drops expired entries
+func CacheResponse(key string, model string, persona string, response string) {
+	if !registry.Config.AiCache.Enabled || response == "" {
+		return
+	}
+
+	_, err := database.DB.Exec(
+		"INSERT OR REPLACE INTO ai_cache (key, model, persona, response, hits, unixtime) VALUES (?, ?, ?, ?, 0, ?)",
+		key, model, persona, response, time.Now().Unix())
+	if err != nil {
+		log.Printf("AI: error saving cache: %v", err)
+	}
+
+	_, err = database.DB.Exec("DELETE FROM ai_cache WHERE unixtime < ?", time.Now().Add(-cacheTTL()).Unix())
+	if err != nil {
+		log.Printf("AI: error expiring cache: %v", err)
+	}
+}
+
+func cacheTTL() time.Duration {
+	if registry.Config.AiCache.TTL > 0 {
+		return registry.Config.AiCache.TTL
+	}
+
+	return time.Hour
+}
+
+// countCache increments the hits or misses column of today's stats
+func countCache(column string) {
+	day := time.Now().In(registry.Config.TimeLoc).Format("2006-01-02")
+
+	_, err := database.DB.Exec(
+		"INSERT INTO ai_cache_stats (day, "+column+") VALUES (?, 1) ON CONFLICT(day) DO UPDATE SET "+column+" = "+column+" + 1",
+		day)
+	if err != nil {
+		log.Printf("AI: error counting cache %v: %v", column, err)
+	}
+}
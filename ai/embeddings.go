@@ -0,0 +1,80 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// newEmbeddingsClient builds a client for the embeddings endpoint,
+// which may differ from the chat provider since OpenRouter has none
+func newEmbeddingsClient() *openai.Client {
+	config := registry.Config.SemanticMemory
+
+	apiKey := config.ApiKey
+	if apiKey == "" {
+		apiKey = registry.Config.OpenaiApiKey
+	}
+
+	clientConfig := openai.DefaultConfig(apiKey)
+	if config.BaseURL != "" {
+		clientConfig.BaseURL = config.BaseURL
+	} else if registry.Config.AiBaseURL != "" {
+		clientConfig.BaseURL = registry.Config.AiBaseURL
+	}
+
+	return openai.NewClientWithConfig(clientConfig)
+}
+
+// Embed returns embedding vectors for the texts in the same order
+func Embed(ctx context.Context, call Call, texts []string) ([][]float32, error) {
+	client := newEmbeddingsClient()
+	model := registry.Config.SemanticMemory.Model
+
+	started := time.Now()
+	resp, err := client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+		Input: texts,
+		Model: openai.EmbeddingModel(model),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recordUsage(call, model, resp.Usage.PromptTokens, 0, time.Since(started))
+
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(resp.Data))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, embedding := range resp.Data {
+		if embedding.Index < 0 || embedding.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", embedding.Index)
+		}
+		vectors[embedding.Index] = embedding.Embedding
+	}
+
+	return vectors, nil
+}
+
+// IsRejected reports whether the provider refused the input itself,
+// for example for being over the token limit, so retrying won't help
+func IsRejected(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusBadRequest || apiErr.HTTPStatusCode == http.StatusRequestEntityTooLarge
+	}
+
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode == http.StatusBadRequest || requestErr.HTTPStatusCode == http.StatusRequestEntityTooLarge
+	}
+
+	return false
+}
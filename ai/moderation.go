@@ -0,0 +1,68 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// newModerationClient builds a client for the moderation endpoint, OpenAI by default
+func newModerationClient() *openai.Client {
+	config := registry.Config.Moderation
+
+	apiKey := config.ApiKey
+	if apiKey == "" {
+		apiKey = registry.Config.OpenaiApiKey
+	}
+
+	clientConfig := openai.DefaultConfig(apiKey)
+	if config.BaseURL != "" {
+		clientConfig.BaseURL = config.BaseURL
+	} else if registry.Config.AiBaseURL != "" {
+		clientConfig.BaseURL = registry.Config.AiBaseURL
+	}
+
+	return openai.NewClientWithConfig(clientConfig)
+}
+
+// Moderate asks the moderation endpoint about the text and returns
+// the flagged categories, none means the text is fine
+func Moderate(ctx context.Context, text string) ([]string, error) {
+	resp, err := newModerationClient().Moderations(ctx, openai.ModerationRequest{
+		Input: text,
+		Model: registry.Config.Moderation.Model,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var flagged []string
+	for _, result := range resp.Results {
+		if !result.Flagged {
+			continue
+		}
+
+		// Categories is a struct of booleans named like the API fields
+		var categories map[string]bool
+		data, _ := json.Marshal(result.Categories)
+		json.Unmarshal(data, &categories)
+
+		for category, set := range categories {
+			if set {
+				flagged = append(flagged, category)
+			}
+		}
+
+		if len(flagged) == 0 {
+			flagged = append(flagged, "flagged")
+		}
+	}
+
+	sort.Strings(flagged)
+
+	return flagged, nil
+}
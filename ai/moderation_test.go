@@ -0,0 +1,63 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+func TestModerate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/moderations" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+
+		var request openai.ModerationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+
+		var result openai.Result
+		switch {
+		case strings.Contains(request.Input, "threat"):
+			result.Flagged = true
+			result.Categories.Violence = true
+			result.Categories.HarassmentThreatening = true
+		case strings.Contains(request.Input, "vague"):
+			result.Flagged = true
+		}
+
+		json.NewEncoder(w).Encode(openai.ModerationResponse{Results: []openai.Result{result}})
+	}))
+	defer server.Close()
+
+	registry.Config.Moderation = registry.ModerationConfig{BaseURL: server.URL, Model: openai.ModerationOmniLatest}
+	defer func() { registry.Config.Moderation = registry.ModerationConfig{} }()
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello there", nil},
+		{"a threat", []string{"harassment/threatening", "violence"}},
+		{"something vague", []string{"flagged"}},
+	}
+
+	for _, test := range tests {
+		got, err := Moderate(context.Background(), test.text)
+		if err != nil {
+			t.Fatalf("Moderate(%q): %v", test.text, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Moderate(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package ai
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// newTranscriptionClient builds a client for the transcription endpoint,
+// which is usually OpenAI or a local whisper server rather than the chat provider
+func newTranscriptionClient() *openai.Client {
+	config := registry.Config.Transcription
+
+	apiKey := config.ApiKey
+	if apiKey == "" {
+		apiKey = registry.Config.OpenaiApiKey
+	}
+
+	clientConfig := openai.DefaultConfig(apiKey)
+	if config.BaseURL != "" {
+		clientConfig.BaseURL = config.BaseURL
+	} else if registry.Config.AiBaseURL != "" {
+		clientConfig.BaseURL = registry.Config.AiBaseURL
+	}
+
+	return openai.NewClientWithConfig(clientConfig)
+}
+
+// Transcribe converts the recording to text, fileName tells the server the audio format
+// and duration in seconds is used to price the request
+func Transcribe(ctx context.Context, call Call, fileName string, audio io.Reader, duration int) (string, error) {
+	config := registry.Config.Transcription
+
+	model := config.Model
+	if model == "" {
+		model = openai.Whisper1
+	}
+
+	if err := checkBudget(call); err != nil {
+		return "", err
+	}
+
+	started := time.Now()
+	resp, err := newTranscriptionClient().CreateTranscription(ctx, openai.AudioRequest{
+		Model:    model,
+		FilePath: fileName,
+		Reader:   audio,
+		Language: config.Language,
+		Format:   openai.AudioResponseFormatJSON,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	recordAudioUsage(call, model, duration, time.Since(started))
+
+	return strings.TrimSpace(resp.Text), nil
+}
@@ -0,0 +1,176 @@
+package ai
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// ErrBudgetExceeded is returned when the chat or the user has spent their AI budget
+var ErrBudgetExceeded = errors.New("AI budget exceeded")
+
+// ErrRateLimited is returned when the user sends too many AI requests
+var ErrRateLimited = errors.New("too many AI requests")
+
+// Call describes who an AI request is made for, zero IDs mean the bot itself.
+// The completions of one user request share the RequestID, so the request
+// counts once against the hourly limit.
+type Call struct {
+	ChatID    int64
+	UserID    int
+	Purpose   string
+	RequestID string
+}
+
+// Models already warned about having no price
+var unpriced = map[string]bool{}
+var unpricedMutex sync.Mutex
+
+// NewCall starts a user request
+func NewCall(chatID int64, userID int, purpose string) Call {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return Call{ChatID: chatID, UserID: userID, Purpose: purpose, RequestID: hex.EncodeToString(id)}
+}
+
+// Refusal returns the polite message shown when a request is refused
+func Refusal() string {
+	if registry.Config.AiBudgets.Refusal != "" {
+		return registry.Config.AiBudgets.Refusal
+	}
+
+	return "Лимит запросов к ИИ исчерпан, попробуйте позже 🙏"
+}
+
+// estimateCost uses the configured price table, unknown models are free
+func estimateCost(model string, promptTokens int, completionTokens int) float64 {
+	price, ok := registry.Config.AiPrices[model]
+	if !ok {
+		warnUnpriced(model)
+		return 0
+	}
+
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1000000
+}
+
+func recordUsage(call Call, model string, promptTokens int, completionTokens int, latency time.Duration) {
+	cost := estimateCost(model, promptTokens, completionTokens)
+
+	log.Printf("AI: %v %v used %v+%v tokens in %v, $%.6f", call.Purpose, model, promptTokens, completionTokens, latency, cost)
+
+	saveUsage(call, model, promptTokens, completionTokens, latency, cost)
+}
+
+// recordAudioUsage prices audio by the minute since it has no tokens
+func recordAudioUsage(call Call, model string, seconds int, latency time.Duration) {
+	price, ok := registry.Config.AiPrices[model]
+	if !ok {
+		warnUnpriced(model)
+	}
+	cost := float64(seconds) / 60 * price.Minute
+
+	log.Printf("AI: %v %v processed %vs of audio in %v, $%.6f", call.Purpose, model, seconds, latency, cost)
+
+	saveUsage(call, model, 0, 0, latency, cost)
+}
+
+// warnUnpriced logs once per model that its usage doesn't count against the budgets
+func warnUnpriced(model string) {
+	unpricedMutex.Lock()
+	defer unpricedMutex.Unlock()
+
+	if unpriced[model] {
+		return
+	}
+	unpriced[model] = true
+
+	log.Printf("AI: warning, %v has no price in ai_prices, its usage is free for the budgets", model)
+}
+
+func saveUsage(call Call, model string, promptTokens int, completionTokens int, latency time.Duration, cost float64) {
+	_, err := database.DB.Exec(
+		`INSERT INTO ai_usage (
+			chat_id, user_id, model, purpose, prompt_tokens, completion_tokens, latency_ms, cost, unixtime, request_id
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
+		call.ChatID, call.UserID, model, call.Purpose, promptTokens, completionTokens,
+		latency.Milliseconds(), cost, time.Now().Unix(), call.RequestID)
+	if err != nil {
+		log.Printf("AI: error saving usage: %v", err)
+	}
+}
+
+// checkBudget refuses the call when the chat or the user is over their limits
+func checkBudget(call Call) error {
+	budgets := registry.Config.AiBudgets
+	now := time.Now().In(registry.Config.TimeLoc)
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Unix()
+
+	if call.ChatID != 0 {
+		daily, monthly := budgets.ChatDaily, budgets.ChatMonthly
+		for _, chat := range budgets.Chats {
+			if chat.ChatID == call.ChatID {
+				daily, monthly = chat.Daily, chat.Monthly
+				break
+			}
+		}
+
+		if overBudget("chat_id", call.ChatID, dayStart, daily) || overBudget("chat_id", call.ChatID, monthStart, monthly) {
+			log.Printf("AI: chat %v is over budget", call.ChatID)
+			return ErrBudgetExceeded
+		}
+	}
+
+	if call.UserID != 0 {
+		if overBudget("user_id", call.UserID, dayStart, budgets.UserDaily) ||
+			overBudget("user_id", call.UserID, monthStart, budgets.UserMonthly) {
+			log.Printf("AI: user %v is over budget", call.UserID)
+			return ErrBudgetExceeded
+		}
+
+		// Earlier completions of the same request don't count, so a request
+		// isn't cut off halfway through its tool rounds or chunks
+		if budgets.UserRequestsPerHour > 0 {
+			var requests int
+			err := database.DB.QueryRow(
+				`SELECT COUNT(DISTINCT COALESCE(request_id, 'row' || id)) FROM ai_usage
+				WHERE user_id = ? AND unixtime >= ? AND purpose != 'embeddings'
+					AND (request_id IS NULL OR request_id != ?)`,
+				call.UserID, time.Now().Add(-time.Hour).Unix(), call.RequestID).Scan(&requests)
+			if err != nil {
+				log.Printf("AI: error counting requests: %v", err)
+			} else if requests >= budgets.UserRequestsPerHour {
+				log.Printf("AI: user %v is rate limited", call.UserID)
+				return ErrRateLimited
+			}
+		}
+	}
+
+	return nil
+}
+
+// overBudget reports whether the spending since the given time reached the limit,
+// column is either chat_id or user_id
+func overBudget(column string, id interface{}, since int64, limit float64) bool {
+	if limit <= 0 {
+		return false
+	}
+
+	var spent float64
+	err := database.DB.QueryRow(
+		"SELECT COALESCE(SUM(cost), 0) FROM ai_usage WHERE "+column+" = ? AND unixtime >= ?",
+		id, since).Scan(&spent)
+	if err != nil {
+		log.Printf("AI: error checking budget: %v", err)
+		return false
+	}
+
+	return spent >= limit
+}
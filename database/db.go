@@ -150,11 +150,65 @@ func Initialize() {
 		);
 
 		-- Plugin-specific tables
+		-- Rows without chat_id and user_id come from the username-keyed table
 		CREATE TABLE IF NOT EXISTS birthday_notifications (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER,
+			user_id INTEGER,
 			username TEXT,
 			year INTEGER,
-			UNIQUE(username, year)
+			kind TEXT DEFAULT 'birthday',  -- birthday or remind_<days>
+			UNIQUE(chat_id, user_id, year, kind)
+		);
+
+		-- Members who want birthday reminders in private messages
+		CREATE TABLE IF NOT EXISTS birthday_reminder_subscriptions (
+			chat_id INTEGER,
+			user_id INTEGER,
+			PRIMARY KEY (chat_id, user_id)
+		);
+
+		-- Birthdays registered by members, year is NULL when unknown
+		CREATE TABLE IF NOT EXISTS birthdays (
+			chat_id INTEGER,
+			user_id INTEGER,
+			month INTEGER,
+			day INTEGER,
+			year INTEGER,
+			set_by INTEGER,
+			unixtime INTEGER,
+			PRIMARY KEY (chat_id, user_id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+
+		-- Config birthdays already copied to the birthdays table
+		CREATE TABLE IF NOT EXISTS birthday_imports (
+			chat_id INTEGER,
+			username TEXT,
+			PRIMARY KEY (chat_id, username)
+		);
+
+		-- Recurring chat events: anniversaries, meetups and the like.
+		-- year is NULL when unknown, weekday is used by weekly events
+		CREATE TABLE IF NOT EXISTS events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER,
+			type TEXT,
+			recurrence TEXT,  -- yearly, monthly or weekly
+			title TEXT,
+			text TEXT,  -- announcement template, empty for the type default
+			year INTEGER,
+			month INTEGER,
+			day INTEGER,
+			weekday INTEGER,
+			created_by INTEGER,
+			unixtime INTEGER
+		);
+
+		CREATE TABLE IF NOT EXISTS event_notifications (
+			event_id INTEGER,
+			date TEXT,
+			PRIMARY KEY (event_id, date)
 		);
 
 		CREATE TABLE IF NOT EXISTS dupe_links (
@@ -162,6 +216,30 @@ func Initialize() {
 			url TEXT,
 			message_id INTEGER,
 			sender_id INTEGER,
+			chat_id INTEGER,
+			unixtime INTEGER,
+			FOREIGN KEY (sender_id) REFERENCES users(id)
+		);
+
+		-- Reposts reported by dupelink, key is the link or what identifies the post
+		CREATE TABLE IF NOT EXISTS dupe_hits (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER,
+			kind TEXT,  -- link, forward or photo
+			key TEXT,
+			sender_id INTEGER,
+			original_sender_id INTEGER,
+			message_id INTEGER,
+			unixtime INTEGER
+		);
+
+		-- Perceptual hashes of the photos posted in chats
+		CREATE TABLE IF NOT EXISTS image_hashes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER,
+			message_id INTEGER,
+			sender_id INTEGER,
+			hash INTEGER,
 			unixtime INTEGER,
 			FOREIGN KEY (sender_id) REFERENCES users(id)
 		);
@@ -187,18 +265,271 @@ func Initialize() {
 			created_at INTEGER DEFAULT (strftime('%s', 'now'))
 		);
 
+		-- Semantic memory, vectors are little-endian float32 normalized to unit length
+		CREATE TABLE IF NOT EXISTS message_embeddings (
+			message_id INTEGER,
+			chat_id INTEGER,
+			model TEXT,
+			vector BLOB,  -- NULL when the provider refused the message
+			PRIMARY KEY (message_id, chat_id),
+			FOREIGN KEY (message_id, chat_id) REFERENCES messages(id, chat_id)
+		);
+
+		-- AI usage accounting
+		CREATE TABLE IF NOT EXISTS ai_usage (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER,
+			user_id INTEGER,
+			model TEXT,
+			purpose TEXT,  -- reply, tldr, digest, embeddings, etc.
+			prompt_tokens INTEGER,
+			completion_tokens INTEGER,
+			latency_ms INTEGER,
+			cost REAL,  -- estimated, USD
+			unixtime INTEGER,
+			request_id TEXT  -- shared by the completions of one user request
+		);
+
+		-- Transcripts of voice and video notes
+		CREATE TABLE IF NOT EXISTS transcripts (
+			message_id INTEGER,
+			chat_id INTEGER,
+			model TEXT,
+			text TEXT,
+			unixtime INTEGER,
+			PRIMARY KEY (message_id, chat_id),
+			FOREIGN KEY (message_id, chat_id) REFERENCES messages(id, chat_id)
+		);
+
+		-- Personas picked by chat admins
+		CREATE TABLE IF NOT EXISTS chat_personas (
+			chat_id INTEGER PRIMARY KEY,
+			persona TEXT,
+			set_by INTEGER,
+			unixtime INTEGER
+		);
+
+		-- Facts members asked the assistant to remember
+		CREATE TABLE IF NOT EXISTS user_memories (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER,
+			chat_id INTEGER,
+			text TEXT,
+			unixtime INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+
+		-- Cached AI replies, key is a sha256 of the prompt, model, persona and context
+		CREATE TABLE IF NOT EXISTS ai_cache (
+			key TEXT PRIMARY KEY,
+			model TEXT,
+			persona TEXT,
+			response TEXT,
+			hits INTEGER DEFAULT 0,
+			unixtime INTEGER
+		);
+
+		-- AI cache hits and misses per local day
+		CREATE TABLE IF NOT EXISTS ai_cache_stats (
+			day TEXT PRIMARY KEY,  -- YYYY-MM-DD
+			hits INTEGER DEFAULT 0,
+			misses INTEGER DEFAULT 0
+		);
+
+		-- Moderation decisions on AI input and output
+		CREATE TABLE IF NOT EXISTS moderation_audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER,
+			user_id INTEGER,
+			stage TEXT,  -- input or output
+			check_name TEXT,
+			action TEXT,  -- block, redact or log
+			reason TEXT,
+			excerpt TEXT,
+			unixtime INTEGER
+		);
+
+		-- Markov chains, two word prefixes per chat and author
+		CREATE TABLE IF NOT EXISTS markov_ngrams (
+			chat_id INTEGER,
+			user_id INTEGER,
+			prefix TEXT,
+			next TEXT,
+			count INTEGER,
+			PRIMARY KEY (chat_id, user_id, prefix, next)
+		);
+
+		-- Last row the Markov chains were trained on, in (unixtime, chat_id, id) order
+		CREATE TABLE IF NOT EXISTS markov_progress (
+			source TEXT PRIMARY KEY,  -- messages or transcripts
+			unixtime INTEGER,
+			chat_id INTEGER,
+			message_id INTEGER
+		);
+
+		-- Scheduler state
+		CREATE TABLE IF NOT EXISTS scheduled_jobs (
+			name TEXT PRIMARY KEY,
+			last_run TEXT  -- local date of the last successful run, YYYY-MM-DD
+		);
+
 		CREATE INDEX IF NOT EXISTS idx_messages_unixtime ON messages(unixtime);
 		CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id);
 		CREATE INDEX IF NOT EXISTS idx_messages_media_group ON messages(media_group_id);
 		CREATE INDEX IF NOT EXISTS idx_media_items_file_id ON media_items(file_id);
 		CREATE INDEX IF NOT EXISTS idx_dupe_links_url ON dupe_links(url);
-		CREATE INDEX IF NOT EXISTS idx_birthday_notifications_username ON birthday_notifications(username);
+		CREATE INDEX IF NOT EXISTS idx_events_chat ON events(chat_id);
+		CREATE INDEX IF NOT EXISTS idx_image_hashes_chat ON image_hashes(chat_id);
+		CREATE INDEX IF NOT EXISTS idx_image_hashes_chat_time ON image_hashes(chat_id, unixtime);
+		CREATE INDEX IF NOT EXISTS idx_dupe_hits_chat ON dupe_hits(chat_id);
 		CREATE INDEX IF NOT EXISTS idx_helix_streams_user_name ON helix_streams(user_name);
 		CREATE INDEX IF NOT EXISTS idx_stream_notifications_stream_id ON stream_notifications(stream_id);
+		CREATE INDEX IF NOT EXISTS idx_message_embeddings_chat ON message_embeddings(chat_id, model);
+		CREATE INDEX IF NOT EXISTS idx_ai_usage_chat ON ai_usage(chat_id, unixtime);
+		CREATE INDEX IF NOT EXISTS idx_ai_usage_user ON ai_usage(user_id, unixtime);
+		CREATE INDEX IF NOT EXISTS idx_user_memories_user ON user_memories(user_id, chat_id);
+		CREATE INDEX IF NOT EXISTS idx_markov_ngrams_prefix ON markov_ngrams(chat_id, prefix);
 	`)
 	if err != nil {
 		log.Fatal("Failed to create tables:", err)
 	}
+
+	// Columns added after the initial schema
+	ensureColumn("dupe_links", "chat_id", "INTEGER")
+	ensureColumn("ai_usage", "request_id", "TEXT")
+	migrateBirthdayNotifications()
+	migrateMarkovProgress()
+
+	_, err = DB.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_dupe_links_chat ON dupe_links(chat_id);
+		CREATE INDEX IF NOT EXISTS idx_birthday_notifications_username ON birthday_notifications(username);
+	`)
+	if err != nil {
+		log.Fatal("Failed to create indexes:", err)
+	}
+}
+
+// migrateBirthdayNotifications keys the notifications by chat and user ID,
+// the table is recreated because SQLite can't change the UNIQUE constraint
+// in place. Old rows are kept as legacy username rows.
+func migrateBirthdayNotifications() {
+	if hasColumn("birthday_notifications", "chat_id") {
+		return
+	}
+
+	log.Printf("Migrating birthday_notifications")
+
+	// The oldest tables have no kind column
+	kind := "'birthday'"
+	if hasColumn("birthday_notifications", "kind") {
+		kind = "COALESCE(kind, 'birthday')"
+	}
+
+	err := WithTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE birthday_notifications_new (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				chat_id INTEGER,
+				user_id INTEGER,
+				username TEXT,
+				year INTEGER,
+				kind TEXT DEFAULT 'birthday',
+				UNIQUE(chat_id, user_id, year, kind)
+			);
+
+			INSERT INTO birthday_notifications_new (id, username, year, kind)
+			SELECT id, username, year, ` + kind + ` FROM birthday_notifications;
+
+			DROP TABLE birthday_notifications;
+
+			ALTER TABLE birthday_notifications_new RENAME TO birthday_notifications;
+		`)
+		return err
+	})
+	if err != nil {
+		log.Fatal("Failed to migrate birthday_notifications:", err)
+	}
+}
+
+// migrateMarkovProgress replaces the rowid marker, which moved whenever
+// a message row was replaced, with the newest message it had covered.
+// Transcripts start from the latest one unless nothing was trained yet.
+func migrateMarkovProgress() {
+	if !hasColumn("markov_progress", "last_rowid") {
+		return
+	}
+
+	log.Printf("Migrating markov_progress")
+
+	err := WithTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE markov_progress_new (
+				source TEXT PRIMARY KEY,
+				unixtime INTEGER,
+				chat_id INTEGER,
+				message_id INTEGER
+			);
+
+			INSERT INTO markov_progress_new (source, unixtime, chat_id, message_id)
+			SELECT 'messages', m.unixtime, m.chat_id, m.id
+			FROM messages m, markov_progress p
+			WHERE p.id = 1 AND m.rowid <= p.last_rowid
+			ORDER BY m.unixtime DESC, m.chat_id DESC, m.id DESC LIMIT 1;
+
+			INSERT INTO markov_progress_new (source, unixtime, chat_id, message_id)
+			SELECT 'transcripts', unixtime, chat_id, message_id FROM transcripts
+			WHERE EXISTS (SELECT 1 FROM markov_progress_new)
+			ORDER BY unixtime DESC, chat_id DESC, message_id DESC LIMIT 1;
+
+			DROP TABLE markov_progress;
+
+			ALTER TABLE markov_progress_new RENAME TO markov_progress;
+		`)
+		return err
+	})
+	if err != nil {
+		log.Fatal("Failed to migrate markov_progress:", err)
+	}
+}
+
+// hasColumn reports whether the table has the column
+func hasColumn(table string, column string) bool {
+	rows, err := DB.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		log.Fatal("Failed to read table info:", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid              int
+			name, columnType string
+			notNull, pk      int
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			log.Fatal("Failed to scan table info:", err)
+		}
+		if name == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ensureColumn adds a column to an existing table if it is missing
+func ensureColumn(table string, column string, definition string) {
+	if hasColumn(table, column) {
+		return
+	}
+
+	log.Printf("Adding column %s.%s", table, column)
+
+	_, err := DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil {
+		log.Fatal("Failed to add column:", err)
+	}
 }
 
 func Close() {
@@ -0,0 +1,121 @@
+// Package imagehash computes perceptual hashes that stay the same when
+// an image is recompressed, resized or slightly recolored
+package imagehash
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math"
+	"math/bits"
+
+	// Telegram sends photos as JPEG. Stickers are WebP, which isn't
+	// registered, so they can't be hashed.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// ErrFlat is returned for images with too little detail to tell them apart,
+// such as blank pictures and plain gradients
+var ErrFlat = errors.New("image is too flat to hash")
+
+// Below these the hash says little about the image
+const (
+	minDeviation = 0.02 * 0xffff
+	minBits      = 4
+)
+
+// DHash compares the brightness of neighbouring cells of a 9x8 grayscale
+// thumbnail, every bit tells whether a cell is brighter than the next one
+func DHash(img image.Image) uint64 {
+	return dhash(thumbnail(img, 9, 8))
+}
+
+func dhash(cells [][]float64) uint64 {
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// DHashBytes decodes the image and hashes it, flat images get ErrFlat
+func DHashBytes(data []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	cells := thumbnail(img, 9, 8)
+	if deviation(cells) < minDeviation {
+		return 0, ErrFlat
+	}
+
+	hash := dhash(cells)
+	if ones := bits.OnesCount64(hash); ones < minBits || ones > 64-minBits {
+		return 0, ErrFlat
+	}
+
+	return hash, nil
+}
+
+// Distance is the number of differing bits, 0 means the images look the same
+func Distance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// deviation is the standard deviation of the cell luminance
+func deviation(cells [][]float64) float64 {
+	var sum, squares float64
+	var n int
+
+	for _, row := range cells {
+		for _, cell := range row {
+			sum += cell
+			squares += cell * cell
+			n++
+		}
+	}
+
+	mean := sum / float64(n)
+	return math.Sqrt(math.Max(squares/float64(n)-mean*mean, 0))
+}
+
+// thumbnail averages the luminance of the image over a width x height grid
+func thumbnail(img image.Image, width int, height int) [][]float64 {
+	bounds := img.Bounds()
+	sums := make([][]float64, height)
+	counts := make([][]int, height)
+	for y := range sums {
+		sums[y] = make([]float64, width)
+		counts[y] = make([]int, width)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		cy := (y - bounds.Min.Y) * height / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cx := (x - bounds.Min.X) * width / bounds.Dx()
+
+			r, g, b, _ := img.At(x, y).RGBA()
+			sums[cy][cx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			counts[cy][cx]++
+		}
+	}
+
+	for y := range sums {
+		for x := range sums[y] {
+			if counts[y][x] > 0 {
+				sums[y][x] /= float64(counts[y][x])
+			}
+		}
+	}
+
+	return sums
+}
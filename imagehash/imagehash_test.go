@@ -0,0 +1,70 @@
+package imagehash
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// threshold is the default of the dupe_images config
+const threshold = 6
+
+func hashFile(t *testing.T, name string) (uint64, error) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return DHashBytes(data)
+}
+
+func TestDHashBytes(t *testing.T) {
+	photo, err := hashFile(t, "photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A smaller, recompressed JPEG copy of the same photo
+	resized, err := hashFile(t, "photo_resized.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distance := Distance(photo, resized); distance > threshold {
+		t.Errorf("resized copy is %d bits away, want at most %d", distance, threshold)
+	}
+
+	unrelated, err := hashFile(t, "unrelated.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distance := Distance(photo, unrelated); distance <= threshold {
+		t.Errorf("unrelated image is %d bits away, want more than %d", distance, threshold)
+	}
+}
+
+func TestDHashBytesFlat(t *testing.T) {
+	if _, err := hashFile(t, "blank.png"); !errors.Is(err, ErrFlat) {
+		t.Errorf("got %v for a blank image, want ErrFlat", err)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0xff, 0xff, 0},
+		{0b1010, 0b0101, 4},
+		{0, ^uint64(0), 64},
+	}
+
+	for _, test := range tests {
+		if got := Distance(test.a, test.b); got != test.want {
+			t.Errorf("Distance(%x, %x) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Package markup turns the Markdown written by language models into
+// Telegram HTML and splits long texts into message-sized chunks
+package markup
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// MaxMessageLength is the Telegram limit on the text of a message,
+// in UTF-16 code units
+const MaxMessageLength = 4096
+
+var (
+	fenceExp       = regexp.MustCompile("^\\s*```\\s*([\\w+#.-]*)\\s*$")
+	codeSpanExp    = regexp.MustCompile("`([^`\n]+)`")
+	linkExp        = regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^)\s]+)\)`)
+	urlExp         = regexp.MustCompile(`https?://[^\s<>"]+`)
+	boldStarExp    = regexp.MustCompile(`\*\*((?:[^*\n]|\*[^*\n]+\*)+?)\*\*`)
+	boldLineExp    = regexp.MustCompile(`(^|[^\p{L}\p{N}_])__([^_\s](?:[^_\n]*?[^_\s])?)__($|[^\p{L}\p{N}_])`)
+	identifierExp  = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+	strikeExp      = regexp.MustCompile(`~~([^~\n]+?)~~`)
+	italicStarExp  = regexp.MustCompile(`(^|[^\p{L}\p{N}*])\*([^*\s](?:[^*\n]*?[^*\s])?)\*($|[^\p{L}\p{N}*])`)
+	italicLineExp  = regexp.MustCompile(`(^|[^\p{L}\p{N}_])_([^_\s](?:[^_\n]*?[^_\s])?)_($|[^\p{L}\p{N}_])`)
+	headingExp     = regexp.MustCompile(`^#{1,6}\s+(.+?)\s*#*$`)
+	bulletExp      = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	quoteExp       = regexp.MustCompile(`^>\s?`)
+	placeholderExp = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// Escape makes the text safe to put into a Telegram HTML message
+func Escape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(text)
+}
+
+// ToHTML converts Markdown into the HTML subset Telegram understands.
+// Markers it can't pair are left as they are.
+func ToHTML(markdown string) string {
+	var result []string
+	var code []string
+	var quote []string
+	inCode := false
+	language := ""
+
+	flushQuote := func() {
+		if len(quote) > 0 {
+			result = append(result, "<blockquote>"+strings.Join(quote, "\n")+"</blockquote>")
+			quote = nil
+		}
+	}
+
+	for _, line := range strings.Split(markdown, "\n") {
+		if match := fenceExp.FindStringSubmatch(line); match != nil {
+			if inCode {
+				result = append(result, codeBlock(code, language))
+				code = nil
+				inCode = false
+			} else {
+				flushQuote()
+				language = match[1]
+				inCode = true
+			}
+			continue
+		}
+
+		if inCode {
+			code = append(code, line)
+			continue
+		}
+
+		if quoteExp.MatchString(line) {
+			quote = append(quote, inline(quoteExp.ReplaceAllString(line, "")))
+			continue
+		}
+		flushQuote()
+
+		if match := headingExp.FindStringSubmatch(line); match != nil {
+			result = append(result, "<b>"+inline(match[1])+"</b>")
+			continue
+		}
+
+		result = append(result, inline(bulletExp.ReplaceAllString(line, "${1}• ")))
+	}
+
+	// An unclosed fence still gets its code formatted
+	if inCode {
+		result = append(result, codeBlock(code, language))
+	}
+	flushQuote()
+
+	return strings.Join(result, "\n")
+}
+
+func codeBlock(lines []string, language string) string {
+	text := Escape(strings.Join(lines, "\n"))
+
+	if language != "" {
+		return `<pre><code class="language-` + Escape(language) + `">` + text + "</code></pre>"
+	}
+
+	return "<pre>" + text + "</pre>"
+}
+
+// inline converts the formatting inside a single line. Code, links and
+// URLs are swapped for placeholders first so the emphasis rules can't touch them.
+func inline(line string) string {
+	var saved []string
+	save := func(html string) string {
+		saved = append(saved, html)
+		return "\x00" + strconv.Itoa(len(saved)-1) + "\x00"
+	}
+
+	line = codeSpanExp.ReplaceAllStringFunc(line, func(match string) string {
+		return save("<code>" + Escape(match[1:len(match)-1]) + "</code>")
+	})
+	line = linkExp.ReplaceAllStringFunc(line, func(match string) string {
+		parts := linkExp.FindStringSubmatch(match)
+		return save(`<a href="` + Escape(parts[2]) + `">` + Escape(parts[1]) + "</a>")
+	})
+	line = urlExp.ReplaceAllStringFunc(line, func(match string) string {
+		return save(Escape(match))
+	})
+
+	line = Escape(line)
+
+	line = boldStarExp.ReplaceAllString(line, "<b>$1</b>")
+	line = boldLineExp.ReplaceAllStringFunc(line, func(match string) string {
+		// __init__ and the like are Python names rather than emphasis
+		parts := boldLineExp.FindStringSubmatch(match)
+		if identifierExp.MatchString(parts[2]) {
+			return match
+		}
+		return parts[1] + "<b>" + parts[2] + "</b>" + parts[3]
+	})
+	line = strikeExp.ReplaceAllString(line, "<s>$1</s>")
+	line = italicStarExp.ReplaceAllString(line, "$1<i>$2</i>$3")
+	line = italicLineExp.ReplaceAllString(line, "$1<i>$2</i>$3")
+
+	return placeholderExp.ReplaceAllStringFunc(line, func(match string) string {
+		i, _ := strconv.Atoi(match[1 : len(match)-1])
+		return saved[i]
+	})
+}
+
+// Split cuts Markdown into chunks of at most limit UTF-16 code units, the way
+// Telegram counts message length, preferring
+// paragraph boundaries and keeping code blocks fenced in every chunk
+func Split(markdown string, limit int) []string {
+	var chunks []string
+	var current string
+
+	add := func(block string) {
+		if current == "" {
+			current = block
+		} else if length(current)+2+length(block) <= limit {
+			current += "\n\n" + block
+		} else {
+			chunks = append(chunks, current)
+			current = block
+		}
+	}
+
+	for _, block := range blocks(markdown) {
+		if length(block) <= limit {
+			add(block)
+			continue
+		}
+
+		for _, part := range splitBlock(block, limit) {
+			add(part)
+		}
+	}
+
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+
+	return chunks
+}
+
+// blocks splits the text into paragraphs, a code block is a single paragraph
+// even if it has blank lines
+func blocks(markdown string) []string {
+	var result []string
+	var lines []string
+	inCode := false
+
+	flush := func() {
+		if block := strings.Trim(strings.Join(lines, "\n"), "\n"); block != "" {
+			result = append(result, block)
+		}
+		lines = nil
+	}
+
+	for _, line := range strings.Split(markdown, "\n") {
+		if fenceExp.MatchString(line) {
+			if !inCode {
+				flush()
+			}
+			lines = append(lines, line)
+			if inCode {
+				flush()
+			}
+			inCode = !inCode
+			continue
+		}
+
+		if !inCode && strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+	flush()
+
+	return result
+}
+
+// splitBlock cuts a paragraph that doesn't fit into a single message
+func splitBlock(block string, limit int) []string {
+	lines := strings.Split(block, "\n")
+
+	// Code blocks are cut by lines and fenced again
+	if len(lines) > 1 && fenceExp.MatchString(lines[0]) {
+		opening := strings.TrimSpace(lines[0])
+		body := lines[1:]
+		if len(body) > 0 && fenceExp.MatchString(body[len(body)-1]) {
+			body = body[:len(body)-1]
+		}
+
+		var parts []string
+		for _, part := range cut(strings.Join(body, "\n"), limit-length(opening)-8) {
+			parts = append(parts, opening+"\n"+part+"\n```")
+		}
+		return parts
+	}
+
+	return cut(block, limit)
+}
+
+// cut splits the text at the last line break, sentence end or space
+// that fits, or in the middle of a word when there is none
+func cut(text string, limit int) []string {
+	if limit < 1 {
+		limit = 1
+	}
+
+	var parts []string
+	for length(text) > limit {
+		head := prefix(text, limit)
+
+		at := strings.LastIndex(head, "\n")
+		if at <= 0 {
+			at = strings.LastIndex(head, ". ")
+			if at > 0 {
+				at++
+			}
+		}
+		if at <= 0 {
+			at = strings.LastIndex(head, " ")
+		}
+		if at <= 0 {
+			at = len(head)
+		}
+
+		parts = append(parts, strings.TrimRight(text[:at], " \n"))
+		text = strings.TrimLeft(text[at:], " \n")
+	}
+
+	if text != "" {
+		parts = append(parts, text)
+	}
+
+	return parts
+}
+
+// length counts the text in UTF-16 code units, emoji and other characters
+// outside the Basic Multilingual Plane take two
+func length(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
+
+// prefix returns the longest beginning of the text that fits into limit
+// UTF-16 code units, but at least one character
+func prefix(text string, limit int) string {
+	units := 0
+	for i, r := range text {
+		if r > 0xffff {
+			units += 2
+		} else {
+			units++
+		}
+		if units > limit && i > 0 {
+			return text[:i]
+		}
+	}
+	return text
+}
@@ -0,0 +1,101 @@
+package markup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain", "plain"},
+		{"a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{`say "hi"`, "say &quot;hi&quot;"},
+		{"&amp;", "&amp;amp;"},
+	}
+
+	for _, test := range tests {
+		if got := Escape(test.text); got != test.want {
+			t.Errorf("Escape(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		markdown string
+		want     string
+	}{
+		// Emphasis
+		{"**bold** and *italic*", "<b>bold</b> and <i>italic</i>"},
+		{"__bold text__", "<b>bold text</b>"},
+		{"_italic_ and ~~gone~~", "<i>italic</i> and <s>gone</s>"},
+		{"**b *c* d**", "<b>b <i>c</i> d</b>"},
+		{"***both***", "<b><i>both</i></b>"},
+		{"2 * 3 * 4", "2 * 3 * 4"},
+
+		// Identifiers keep their underscores
+		{"call __init__ first", "call __init__ first"},
+		{"if __name__ == '__main__':", "if __name__ == '__main__':"},
+		{"snake_case_name", "snake_case_name"},
+
+		// Code, links and URLs are left alone
+		{"`**not bold**` <tag>", "<code>**not bold**</code> &lt;tag&gt;"},
+		{"[docs](https://example.com/a_b_c)", `<a href="https://example.com/a_b_c">docs</a>`},
+		{"see https://example.com/__init__", "see https://example.com/__init__"},
+
+		// Blocks
+		{"## Title", "<b>Title</b>"},
+		{"- one\n- two", "• one\n• two"},
+		{"> quoted\n> *text*\nafter", "<blockquote>quoted\n<i>text</i></blockquote>\nafter"},
+		{"```go\nx := a < b\n```", `<pre><code class="language-go">x := a &lt; b</code></pre>`},
+		{"```\n**raw**", "<pre>**raw**</pre>"},
+	}
+
+	for _, test := range tests {
+		if got := ToHTML(test.markdown); got != test.want {
+			t.Errorf("ToHTML(%q) = %q, want %q", test.markdown, got, test.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		limit    int
+		want     []string
+	}{
+		{"fits", "one\n\ntwo", 20, []string{"one\n\ntwo"}},
+		{"paragraphs", "first one\n\nsecond one", 12, []string{"first one", "second one"}},
+		{"words", "aaa bbb ccc", 8, []string{"aaa bbb", "ccc"}},
+		{"sentences", "One two. Three", 12, []string{"One two.", "Three"}},
+		{"long word", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"code", "```go\nline1\nline2\n```", 20, []string{"```go\nline1\n```", "```go\nline2\n```"}},
+
+		// Emoji take two UTF-16 code units
+		{"emoji", "😀😀😀", 4, []string{"😀😀", "😀"}},
+		{"emoji paragraphs", "😀😀\n\n😀", 5, []string{"😀😀", "😀"}},
+		{"emoji over the limit", "😀😀", 1, []string{"😀", "😀"}},
+	}
+
+	for _, test := range tests {
+		got := Split(test.markdown, test.limit)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Split(%q, %d) = %q, want %q", test.name, test.markdown, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestSplitLimit(t *testing.T) {
+	text := strings.Repeat("Привет 👋 мир. ", 1000)
+
+	for _, chunk := range Split(text, MaxMessageLength) {
+		if length(chunk) > MaxMessageLength {
+			t.Errorf("got a chunk of %d code units, want at most %d", length(chunk), MaxMessageLength)
+		}
+	}
+}
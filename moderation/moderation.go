@@ -0,0 +1,192 @@
+// Package moderation checks the text going to and coming from the AI provider
+package moderation
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// Finding is what a check reports about the text, Redacted is the text
+// with the offending parts removed for the redact action
+type Finding struct {
+	Reason   string
+	Redacted string
+}
+
+// Check inspects the text and returns nil when it's fine
+type Check func(ctx context.Context, text string) (*Finding, error)
+
+var Checks = map[string]Check{}
+
+// Checks calling an external service, skipped by ReviewLocal
+var remoteChecks = map[string]bool{"openai": true}
+
+var blocklist []*regexp.Regexp
+var blocklistOnce sync.Once
+
+func init() {
+	RegisterCheck("openai", openaiCheck)
+	RegisterCheck("blocklist", blocklistCheck)
+	RegisterCheck("max_length", maxLengthCheck)
+}
+
+// RegisterCheck makes a check available to the checks config option
+func RegisterCheck(name string, check Check) {
+	Checks[name] = check
+}
+
+// BlockedReply is sent instead of a blocked question or answer
+func BlockedReply() string {
+	if registry.Config.Moderation.BlockedReply != "" {
+		return registry.Config.Moderation.BlockedReply
+	}
+
+	return "Я не буду на это отвечать"
+}
+
+// Review runs the configured checks on the text, stage is input or output.
+// It returns the text to use, redacted if needed, and false if it's blocked.
+func Review(call ai.Call, stage string, text string) (string, bool) {
+	return review(call, stage, text, false)
+}
+
+// ReviewLocal is Review without the checks calling an external service,
+// for text the bot picked up on its own and may well ignore
+func ReviewLocal(call ai.Call, stage string, text string) (string, bool) {
+	return review(call, stage, text, true)
+}
+
+func review(call ai.Call, stage string, text string, local bool) (string, bool) {
+	config := registry.Config.Moderation
+	if !config.Enabled {
+		return text, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, name := range config.Checks {
+		check, ok := Checks[name]
+		if !ok {
+			log.Printf("Moderation: unknown check %v", name)
+			continue
+		}
+		if local && remoteChecks[name] {
+			continue
+		}
+
+		finding, err := check(ctx, text)
+		if err != nil {
+			// Checks fail open so an outage doesn't silence the bot
+			log.Printf("Moderation: check %v failed: %v", name, err)
+			continue
+		}
+		if finding == nil {
+			continue
+		}
+
+		action := config.Actions[name]
+		if action == "" {
+			action = config.Action
+		}
+		if action == "" {
+			action = "block"
+		}
+
+		audit(call, stage, name, action, finding.Reason, text)
+
+		switch action {
+		case "log":
+		case "redact":
+			text = finding.Redacted
+		default:
+			return "", false
+		}
+	}
+
+	return text, true
+}
+
+func audit(call ai.Call, stage string, check string, action string, reason string, text string) {
+	log.Printf("Moderation: %v %v in chat %v: %v, %v", stage, check, call.ChatID, reason, action)
+
+	excerpt := []rune(text)
+	if len(excerpt) > 200 {
+		excerpt = excerpt[:200]
+	}
+
+	_, err := database.DB.Exec(
+		`INSERT INTO moderation_audit (
+			chat_id, user_id, stage, check_name, action, reason, excerpt, unixtime
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		call.ChatID, call.UserID, stage, check, action, reason, string(excerpt), time.Now().Unix())
+	if err != nil {
+		log.Printf("Moderation: error saving audit: %v", err)
+	}
+}
+
+func openaiCheck(ctx context.Context, text string) (*Finding, error) {
+	categories, err := ai.Moderate(ctx, text)
+	if err != nil || len(categories) == 0 {
+		return nil, err
+	}
+
+	return &Finding{
+		Reason:   strings.Join(categories, ", "),
+		Redacted: "[удалено модерацией]",
+	}, nil
+}
+
+func blocklistCheck(ctx context.Context, text string) (*Finding, error) {
+	blocklistOnce.Do(func() {
+		for _, pattern := range registry.Config.Moderation.Blocklist {
+			exp, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Printf("Moderation: skipping bad blocklist pattern %v: %v", pattern, err)
+				continue
+			}
+			blocklist = append(blocklist, exp)
+		}
+	})
+
+	var matched []string
+	redacted := text
+	for _, exp := range blocklist {
+		if exp.MatchString(redacted) {
+			matched = append(matched, exp.String())
+			redacted = exp.ReplaceAllString(redacted, "***")
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	return &Finding{
+		Reason:   "blocklist: " + strings.Join(matched, ", "),
+		Redacted: redacted,
+	}, nil
+}
+
+func maxLengthCheck(ctx context.Context, text string) (*Finding, error) {
+	limit := registry.Config.Moderation.MaxLength
+	runes := []rune(text)
+
+	if limit <= 0 || len(runes) <= limit {
+		return nil, nil
+	}
+
+	return &Finding{
+		Reason:   "longer than " + strconv.Itoa(limit),
+		Redacted: string(runes[:limit]) + "…",
+	}, nil
+}
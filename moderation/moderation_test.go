@@ -0,0 +1,121 @@
+package moderation
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// TestMain creates the bot database for the audit log in a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "muxgoob")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "db"), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	database.Initialize()
+
+	code := m.Run()
+
+	database.DB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// moderationStub flags texts mentioning a threat and fails on an outage
+func moderationStub(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		var request openai.ModerationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+
+		if strings.Contains(request.Input, "outage") {
+			http.Error(w, `{"error": {"message": "overloaded"}}`, http.StatusServiceUnavailable)
+			return
+		}
+
+		var result openai.Result
+		if strings.Contains(request.Input, "threat") {
+			result.Flagged = true
+			result.Categories.Violence = true
+		}
+
+		json.NewEncoder(w).Encode(openai.ModerationResponse{Results: []openai.Result{result}})
+	}))
+}
+
+func TestReview(t *testing.T) {
+	var calls int32
+	server := moderationStub(t, &calls)
+	defer server.Close()
+
+	registry.Config.Moderation = registry.ModerationConfig{
+		Enabled:   true,
+		Checks:    []string{"blocklist", "openai"},
+		Actions:   map[string]string{"blocklist": "redact"},
+		Blocklist: []string{`(?i)secret`},
+		BaseURL:   server.URL,
+		Model:     openai.ModerationOmniLatest,
+	}
+	call := ai.Call{ChatID: -1001, UserID: 42, Purpose: "reply"}
+
+	tests := []struct {
+		name    string
+		review  func(ai.Call, string, string) (string, bool)
+		text    string
+		want    string
+		allowed bool
+		calls   int32
+	}{
+		{"clean", Review, "hello there", "hello there", true, 1},
+		{"redacted", Review, "my Secret plan", "my *** plan", true, 1},
+		{"blocked", Review, "a threat", "", false, 1},
+		{"fails open", Review, "an outage", "an outage", true, 1},
+		{"local skips remote", ReviewLocal, "a threat", "a threat", true, 0},
+		{"local still redacts", ReviewLocal, "the secret threat", "the *** threat", true, 0},
+	}
+
+	for _, test := range tests {
+		atomic.StoreInt32(&calls, 0)
+
+		got, allowed := test.review(call, "input", test.text)
+		if got != test.want || allowed != test.allowed {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, got, allowed, test.want, test.allowed)
+		}
+		if calls != test.calls {
+			t.Errorf("%s: made %d moderation requests, want %d", test.name, calls, test.calls)
+		}
+	}
+
+	var blocked int
+	err := database.DB.QueryRow(
+		"SELECT COUNT(*) FROM moderation_audit WHERE chat_id = ? AND check_name = 'openai' AND action = 'block' AND reason = 'violence'",
+		call.ChatID).Scan(&blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocked != 1 {
+		t.Errorf("got %d audited blocks, want 1", blocked)
+	}
+}
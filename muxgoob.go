@@ -16,8 +16,12 @@ import (
 	_ "github.com/focusshifter/muxgoob/plugins/birthdays"
 	_ "github.com/focusshifter/muxgoob/plugins/dupelink"
 	_ "github.com/focusshifter/muxgoob/plugins/logwrite"
+	_ "github.com/focusshifter/muxgoob/plugins/markov"
 	_ "github.com/focusshifter/muxgoob/plugins/nametrigger"
 	_ "github.com/focusshifter/muxgoob/plugins/reply"
+	_ "github.com/focusshifter/muxgoob/plugins/summary"
+	_ "github.com/focusshifter/muxgoob/plugins/transcribe"
+	_ "github.com/focusshifter/muxgoob/plugins/translate"
 	_ "github.com/focusshifter/muxgoob/plugins/twitchstreams"
 )
 
@@ -41,9 +45,18 @@ func main() {
 	}
 	defer stormDb.Close()
 
+	// Telebot doesn't dispatch voice messages to handlers, so catch them here
+	poller := telebot.NewMiddlewarePoller(&telebot.LongPoller{Timeout: 10 * time.Second}, func(update *telebot.Update) bool {
+		if update.Message != nil && update.Message.Voice != nil {
+			handleMessage(update.Message)
+			return false
+		}
+		return true
+	})
+
 	bot, err := telebot.NewBot(telebot.Settings{
 		Token:  registry.Config.TelegramKey,
-		Poller: &telebot.LongPoller{Timeout: 10 * time.Second},
+		Poller: poller,
 	})
 
 	if err != nil {
@@ -56,81 +69,157 @@ func main() {
 		go d.Start(stormDb)
 	}
 
-	bot.Handle(telebot.OnText, func(message *telebot.Message) {
-		// Save user if not exists
-		userData, _ := json.Marshal(message.Sender)
+	bot.Handle(telebot.OnText, handleMessage)
+	bot.Handle(telebot.OnPhoto, handleMessage)
+	bot.Handle(telebot.OnVideoNote, handleMessage)
+	bot.Handle(telebot.OnVideo, handleMessage)
+	bot.Handle(telebot.OnDocument, handleMessage)
+
+	bot.Start()
+}
+
+// handleMessage saves the incoming message and passes it to the plugins
+func handleMessage(message *telebot.Message) {
+	// Save user if not exists
+	userData, _ := json.Marshal(message.Sender)
+	_, err := database.DB.Exec(
+		"INSERT OR IGNORE INTO users (id, username, first_name, last_name, data) VALUES (?, ?, ?, ?, ?)",
+		message.Sender.ID, message.Sender.Username, message.Sender.FirstName, message.Sender.LastName, string(userData))
+	if err != nil {
+		log.Printf("Error saving user: %v", err)
+	}
+
+	// Save chat if not exists
+	chatData, _ := json.Marshal(message.Chat)
+	_, err = database.DB.Exec(
+		"INSERT OR IGNORE INTO chats (id, type, title, username, first_name, last_name, data) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		message.Chat.ID, message.Chat.Type, message.Chat.Title, message.Chat.Username,
+		message.Chat.FirstName, message.Chat.LastName, string(chatData))
+	if err != nil {
+		log.Printf("Error saving chat: %v", err)
+	}
+
+	// Save message
+	msgData, _ := json.Marshal(message)
+	_, err = database.DB.Exec(
+		`INSERT INTO messages (
+			id, chat_id, sender_id, reply_to_message_id, forward_from_id,
+			forward_from_chat_id, forward_date, edit_date, media_group_id,
+			author_signature, unixtime, text, caption, data
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		message.ID, message.Chat.ID, message.Sender.ID,
+		getMessageID(message.ReplyTo), getUserID(message.OriginalSender),
+		getChatID(message.OriginalChat), message.OriginalUnixtime, message.LastEdit,
+		message.AlbumID, message.Signature, message.Time().Unix(),
+		message.Text, message.Caption, string(msgData))
+	if err != nil {
+		log.Printf("Error saving message: %v", err)
+	}
+
+	// Save message entities
+	for _, entity := range message.Entities {
+		_, err = database.DB.Exec(
+			`INSERT INTO message_entities (
+				message_id, chat_id, type, offset, length, url, user_id, language, is_caption
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, message.Chat.ID, entity.Type, entity.Offset, entity.Length,
+			entity.URL, getUserID(entity.User), "", false)
+		if err != nil {
+			log.Printf("Error saving message entity: %v", err)
+		}
+	}
+
+	for _, entity := range message.CaptionEntities {
 		_, err = database.DB.Exec(
-			"INSERT OR IGNORE INTO users (id, username, first_name, last_name, data) VALUES (?, ?, ?, ?, ?)",
-			message.Sender.ID, message.Sender.Username, message.Sender.FirstName, message.Sender.LastName, string(userData))
+			`INSERT INTO message_entities (
+				message_id, chat_id, type, offset, length, url, user_id, language, is_caption
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, message.Chat.ID, entity.Type, entity.Offset, entity.Length,
+			entity.URL, getUserID(entity.User), "", true)
 		if err != nil {
-			log.Printf("Error saving user: %v", err)
+			log.Printf("Error saving caption entity: %v", err)
 		}
+	}
 
-		// Save chat if not exists
-		chatData, _ := json.Marshal(message.Chat)
+	// Save media items
+	if message.Photo != nil {
+		photoData, _ := json.Marshal(message.Photo)
 		_, err = database.DB.Exec(
-			"INSERT OR IGNORE INTO chats (id, type, title, username, first_name, last_name, data) VALUES (?, ?, ?, ?, ?, ?, ?)",
-			message.Chat.ID, message.Chat.Type, message.Chat.Title, message.Chat.Username,
-			message.Chat.FirstName, message.Chat.LastName, string(chatData))
+			`INSERT INTO media_items (
+				message_id, chat_id, type, file_id, file_unique_id,
+				width, height, file_size, data
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, message.Chat.ID, "photo", message.Photo.FileID, "",
+			message.Photo.Width, message.Photo.Height, message.Photo.FileSize, string(photoData))
 		if err != nil {
-			log.Printf("Error saving chat: %v", err)
+			log.Printf("Error saving photo: %v", err)
 		}
+	}
 
-		// Save message
-		msgData, _ := json.Marshal(message)
+	if message.Voice != nil {
+		voiceData, _ := json.Marshal(message.Voice)
 		_, err = database.DB.Exec(
-			`INSERT INTO messages (
-				id, chat_id, sender_id, reply_to_message_id, forward_from_id,
-				forward_from_chat_id, forward_date, edit_date, media_group_id,
-				author_signature, unixtime, text, caption, data
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			message.ID, message.Chat.ID, message.Sender.ID,
-			getMessageID(message.ReplyTo), getUserID(message.OriginalSender),
-			getChatID(message.OriginalChat), message.OriginalUnixtime, message.LastEdit,
-			message.AlbumID, message.Signature, message.Time().Unix(),
-			message.Text, message.Caption, string(msgData))
+			`INSERT INTO media_items (
+				message_id, chat_id, type, file_id, file_unique_id,
+				duration, mime_type, file_size, data
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, message.Chat.ID, "voice", message.Voice.FileID, "",
+			message.Voice.Duration, message.Voice.MIME, message.Voice.FileSize, string(voiceData))
 		if err != nil {
-			log.Printf("Error saving message: %v", err)
+			log.Printf("Error saving voice: %v", err)
 		}
+	}
 
-		// Save message entities
-		for _, entity := range message.Entities {
-			_, err = database.DB.Exec(
-				`INSERT INTO message_entities (
-					message_id, chat_id, type, offset, length, url, user_id, language, is_caption
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				message.ID, message.Chat.ID, entity.Type, entity.Offset, entity.Length,
-				entity.URL, getUserID(entity.User), "", false)
-			if err != nil {
-				log.Printf("Error saving message entity: %v", err)
-			}
+	if message.VideoNote != nil {
+		videoNoteData, _ := json.Marshal(message.VideoNote)
+		_, err = database.DB.Exec(
+			`INSERT INTO media_items (
+				message_id, chat_id, type, file_id, file_unique_id,
+				duration, file_size, data
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, message.Chat.ID, "video_note", message.VideoNote.FileID, "",
+			message.VideoNote.Duration, message.VideoNote.FileSize, string(videoNoteData))
+		if err != nil {
+			log.Printf("Error saving video note: %v", err)
 		}
+	}
 
-		// Save media items
-		if message.Photo != nil {
-			photoData, _ := json.Marshal(message.Photo)
-			_, err = database.DB.Exec(
-				`INSERT INTO media_items (
-					message_id, chat_id, type, file_id, file_unique_id,
-					width, height, file_size, data
-				) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				message.ID, message.Chat.ID, "photo", message.Photo.FileID, "",
-				message.Photo.Width, message.Photo.Height, message.Photo.FileSize, string(photoData))
-			if err != nil {
-				log.Printf("Error saving photo: %v", err)
-			}
+	if message.Video != nil {
+		videoData, _ := json.Marshal(message.Video)
+		_, err = database.DB.Exec(
+			`INSERT INTO media_items (
+				message_id, chat_id, type, file_id, file_unique_id,
+				width, height, duration, mime_type, file_size, data
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, message.Chat.ID, "video", message.Video.FileID, "",
+			message.Video.Width, message.Video.Height, message.Video.Duration,
+			message.Video.MIME, message.Video.FileSize, string(videoData))
+		if err != nil {
+			log.Printf("Error saving video: %v", err)
 		}
+	}
 
-		for _, d := range registry.Plugins {
-			if obj, ok := d.(interface {
-				Process(*telebot.Message)
-			}); ok {
-				go obj.Process(message)
-			}
+	if message.Document != nil {
+		documentData, _ := json.Marshal(message.Document)
+		_, err = database.DB.Exec(
+			`INSERT INTO media_items (
+				message_id, chat_id, type, file_id, file_unique_id,
+				file_name, mime_type, file_size, data
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.ID, message.Chat.ID, "document", message.Document.FileID, "",
+			message.Document.FileName, message.Document.MIME, message.Document.FileSize, string(documentData))
+		if err != nil {
+			log.Printf("Error saving document: %v", err)
 		}
-	})
+	}
 
-	bot.Start()
+	for _, d := range registry.Plugins {
+		if obj, ok := d.(interface {
+			Process(*telebot.Message)
+		}); ok {
+			go obj.Process(message)
+		}
+	}
 }
 
 func getMessageID(msg *telebot.Message) interface{} {
@@ -2,7 +2,9 @@ package admin
 
 import (
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/tucnak/telebot"
 
@@ -75,4 +77,82 @@ func (p *AdminPlugin) Process(message *telebot.Message) {
 		bot.Send(message.Chat, response)
 		return
 	}
+
+	// Check for /spend command
+	if message.Text == "/spend" {
+		registry.Bot.Send(message.Chat, spendReport())
+		return
+	}
+}
+
+// spendReport summarizes the AI usage of the current day and month
+func spendReport() string {
+	now := time.Now().In(registry.Config.TimeLoc)
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Unix()
+
+	totals := func(since int64) string {
+		var cost float64
+		var requests, tokens int
+		err := database.DB.QueryRow(
+			`SELECT COALESCE(SUM(cost), 0), COUNT(*), COALESCE(SUM(prompt_tokens + completion_tokens), 0)
+			FROM ai_usage WHERE unixtime >= ?`,
+			since).Scan(&cost, &requests, &tokens)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return fmt.Sprintf("$%.4f, %d requests, %d tokens", cost, requests, tokens)
+	}
+
+	top := func(query string) []string {
+		rows, err := database.DB.Query(query, monthStart)
+		if err != nil {
+			return []string{"error: " + err.Error()}
+		}
+		defer rows.Close()
+
+		var lines []string
+		for rows.Next() {
+			var name string
+			var cost float64
+			if err := rows.Scan(&name, &cost); err != nil {
+				return []string{"error: " + err.Error()}
+			}
+			lines = append(lines, fmt.Sprintf("%s: $%.4f", strings.TrimSpace(name), cost))
+		}
+		return lines
+	}
+
+	chats := top(`
+		SELECT COALESCE(c.title, c.username, c.first_name, a.chat_id), SUM(a.cost) AS total
+		FROM ai_usage a
+		LEFT JOIN chats c ON c.id = a.chat_id
+		WHERE a.unixtime >= ? AND a.chat_id != 0
+		GROUP BY a.chat_id
+		ORDER BY total DESC
+		LIMIT 10`)
+
+	users := top(`
+		SELECT COALESCE(NULLIF(u.username, ''), u.first_name || ' ' || u.last_name, a.user_id), SUM(a.cost) AS total
+		FROM ai_usage a
+		LEFT JOIN users u ON u.id = a.user_id
+		WHERE a.unixtime >= ? AND a.user_id != 0
+		GROUP BY a.user_id
+		ORDER BY total DESC
+		LIMIT 10`)
+
+	var hits, misses int
+	err := database.DB.QueryRow(
+		"SELECT COALESCE(SUM(hits), 0), COALESCE(SUM(misses), 0) FROM ai_cache_stats WHERE day >= ?",
+		now.Format("2006-01")+"-01").Scan(&hits, &misses)
+	if err != nil {
+		log.Printf("Admin: error loading cache stats: %v", err)
+	}
+
+	return "AI spend\n\n" +
+		"Today: " + totals(dayStart) + "\n" +
+		"This month: " + totals(monthStart) + "\n\n" +
+		"Top chats this month:\n" + strings.Join(chats, "\n") + "\n\n" +
+		"Top users this month:\n" + strings.Join(users, "\n") + "\n\n" +
+		fmt.Sprintf("Cache this month: %d hits, %d misses", hits, misses)
 }
@@ -1,145 +1,448 @@
 package birthdays
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/bearbin/go-age"
 	"github.com/tucnak/telebot"
 
 	"github.com/focusshifter/muxgoob/database"
 	"github.com/focusshifter/muxgoob/registry"
+	"github.com/focusshifter/muxgoob/scheduler"
 )
 
 type BirthdaysPlugin struct {
 }
 
 var rng *rand.Rand
-type birthdayConfig struct {
-	chatID    int64
-	birthdays map[string]time.Time
-}
+var rngMutex sync.Mutex
+
+// Chats that already have their announcement job running
+var scheduled = map[int64]bool{}
+var scheduledMutex sync.Mutex
 
-var birthdayConfigs []birthdayConfig
+var birthdayExp = regexp.MustCompile(`(?i)^\!(др|birthda(y|ys))(\s+(.+))?$`)
+var isoDateExp = regexp.MustCompile(`^(\d{4})-(\d{1,2})-(\d{1,2})$`)
+var dotDateExp = regexp.MustCompile(`^(\d{1,2})\.(\d{1,2})(\.(\d{4}))?$`)
 
 func init() {
 	registry.RegisterPlugin(&BirthdaysPlugin{})
+	registry.RegisterTool(registry.Tool{
+		Name:        "upcoming_birthdays",
+		Description: "List birthdays of the current chat members within the given number of days, soonest first.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"days": map[string]interface{}{
+					"type":        "integer",
+					"description": "How many days ahead to look, defaults to 30",
+				},
+			},
+		},
+		Handler: upcomingBirthdaysTool,
+	})
 }
 
 func (p *BirthdaysPlugin) Start(interface{}) {
 	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	birthdayConfigs = make([]birthdayConfig, 0)
-
-	loc := registry.Config.TimeLoc
+	importConfigBirthdays()
 
 	for _, config := range registry.Config.Birthdays {
-		bdays := make(map[string]time.Time)
-		for username, birthday := range config.Users {
-			t, _ := time.ParseInLocation("2006-01-02", birthday, loc)
-			bdays[username] = t
-		}
-		birthdayConfigs = append(birthdayConfigs, birthdayConfig{
-			chatID:    config.ChatID,
-			birthdays: bdays,
-		})
+		ensureScheduled(config.ChatID)
+	}
+	for _, chatID := range birthdayChats() {
+		ensureScheduled(chatID)
 	}
 }
 
 func (p *BirthdaysPlugin) Process(message *telebot.Message) {
-	checkTodaysBirthdays(message)
+	importPending(message.Sender)
 	handleBirthdayCommand(message)
+	handleEventCommand(message)
 }
 
-func checkTodaysBirthdays(message *telebot.Message) {
-	bot := registry.Bot
+// chatSchedule returns the announcement time and time zone of the chat
+func chatSchedule(chatID int64) (string, *time.Location) {
+	at := registry.Config.BirthdayTime
 	loc := registry.Config.TimeLoc
 
-	cur := time.Now().In(loc)
-
-	for _, config := range birthdayConfigs {
-		if config.chatID != message.Chat.ID {
+	for _, config := range registry.Config.Birthdays {
+		if config.ChatID != chatID {
 			continue
 		}
-		for username, birthday := range config.birthdays {
-			if cur.Month() == birthday.Month() && cur.Day() == birthday.Day() && notMentioned(username, cur.Year(), message) {
-				age := strconv.Itoa(age.AgeAt(birthday, cur))
-				bot.Send(message.Chat, "Hooray! 🎉 @"+username+" is turning "+age+"! 🎂", &telebot.SendOptions{})
+
+		if config.Time != "" {
+			at = config.Time
+		}
+
+		if config.TimeZone != "" {
+			chatLoc, err := time.LoadLocation(config.TimeZone)
+			if err != nil {
+				log.Printf("Birthday: bad time zone %v for chat %v: %v", config.TimeZone, chatID, err)
+			} else {
+				loc = chatLoc
+			}
+		}
+	}
+
+	if at == "" {
+		at = "10:00"
+	}
+
+	return at, loc
+}
+
+// ensureScheduled starts the daily announcement job of the chat once
+func ensureScheduled(chatID int64) {
+	scheduledMutex.Lock()
+	defer scheduledMutex.Unlock()
+
+	if scheduled[chatID] {
+		return
+	}
+	scheduled[chatID] = true
+
+	at, loc := chatSchedule(chatID)
+	// Notifications are deduplicated, so the first start after the announcement
+	// time still congratulates today's birthdays
+	scheduler.DailyFromToday("birthdays:"+strconv.FormatInt(chatID, 10), at, loc,
+		func(day time.Time) error {
+			if err := announceBirthdays(chatID, day); err != nil {
+				return err
 			}
+			return announceEvents(chatID, day)
+		})
+}
+
+// announceBirthdays congratulates the members of the chat born on the given day,
+// days missed during downtime get a belated greeting
+func announceBirthdays(chatID int64, day time.Time) error {
+	cur := time.Now().In(day.Location())
+	belated := day.Before(time.Date(cur.Year(), cur.Month(), cur.Day(), 0, 0, 0, 0, cur.Location()))
+
+	for _, b := range chatBirthdays(chatID) {
+		if !b.event().occursOn(day) || mentioned(chatID, b, day.Year(), birthdayKind) {
+			continue
 		}
+
+		log.Println("Birthday: notify " + b.key())
+
+		if err := sendGreeting(chatID, b, day, belated); err != nil {
+			return err
+		}
+
+		markMentioned(chatID, b, day.Year(), birthdayKind)
 	}
+
+	return remindBirthdays(chatID, day)
 }
 
 func handleBirthdayCommand(message *telebot.Message) {
-	bot := registry.Bot
-	loc := registry.Config.TimeLoc
+	match := birthdayExp.FindStringSubmatch(message.Text)
+	if match == nil {
+		return
+	}
 
-	birthdayExp := regexp.MustCompile(`(?i)^\!(др|birthda(y|ys))$`)
+	args := strings.Fields(match[4])
+	if len(args) == 0 {
+		nextBirthday(message)
+		return
+	}
 
-	switch {
-	case birthdayExp.MatchString(message.Text):
-		cur := time.Now().In(loc)
-		curDay := cur.YearDay()
+	switch strings.ToLower(args[0]) {
+	case "set":
+		setCommand(message, args[1:])
+	case "remove", "delete":
+		removeCommand(message, args[1:])
+	case "list":
+		listCommand(message)
+	case "month":
+		monthCommand(message, args[1:])
+	case "ics", "export":
+		exportCommand(message)
+	case "remind":
+		remindCommand(message, args[1:])
+	}
+}
 
-		diff := time.Date(cur.Year(), time.December, 31, 0, 0, 0, 0, time.Local).YearDay()
-		curDiff := diff
-		curBirthday := ""
-		curUsername := ""
+// nextBirthday announces the closest upcoming birthdays
+func nextBirthday(message *telebot.Message) {
+	bot := registry.Bot
+	_, loc := chatSchedule(message.Chat.ID)
 
-		for _, config := range birthdayConfigs {
-			if config.chatID != message.Chat.ID {
-				continue
-			}
-			for username, birthday := range config.birthdays {
-				birthdayDay := time.Date(cur.Year(), birthday.Month(), birthday.Day(), 0, 0, 0, 0, time.Local).YearDay()
-				diff = birthdayDay - curDay
-				if diff > 0 {
-					if diff == curDiff {
-						curUsername += ", @" + username
-					} else if diff < curDiff {
-						curDiff = diff
-						curUsername = username
-						curBirthday = birthday.Format("02.01")
-					}
-				}
-			}
+	cur := time.Now().In(loc)
+	tomorrow := time.Date(cur.Year(), cur.Month(), cur.Day()+1, 0, 0, 0, 0, loc)
+
+	var closest time.Time
+	var names []string
+	for _, b := range chatBirthdays(message.Chat.ID) {
+		next := nextOccurrence(b.date(loc), tomorrow)
+
+		switch {
+		case closest.IsZero() || next.Before(closest):
+			closest = next
+			names = []string{b.name()}
+		case next.Equal(closest):
+			names = append(names, b.name())
 		}
+	}
 
-		if curUsername != "" {
-			bot.Send(message.Chat, "Prepare the 🎂 for @"+curUsername+" on "+curBirthday, &telebot.SendOptions{})
-		} else {
-			bot.Send(message.Chat, "No upcoming birthdays", &telebot.SendOptions{})
+	if len(names) == 0 {
+		bot.Send(message.Chat, "No upcoming birthdays", &telebot.SendOptions{})
+		return
+	}
+
+	sort.Strings(names)
+	bot.Send(message.Chat, "Prepare the 🎂 for "+strings.Join(names, ", ")+" on "+closest.Format("02.01"), &telebot.SendOptions{})
+}
+
+// targetUser returns whose birthday the command is about: a mentioned member,
+// the author of the message an admin replied to or the sender. Changing
+// someone else's birthday is for admins only.
+func targetUser(message *telebot.Message, args []string) (int, []string, string) {
+	userID := message.Sender.ID
+
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		id, ok := userByUsername(args[0])
+		if !ok {
+			return 0, nil, "I don't know " + args[0] + " yet"
 		}
+		userID = id
+		args = args[1:]
+	} else if message.ReplyTo != nil && message.ReplyTo.Sender != nil && message.ReplyTo.Sender.ID != userID &&
+		registry.Bot.IsAdmin(message.Chat, message.Sender) {
+		// Members often reply to someone while setting their own birthday
+		userID = message.ReplyTo.Sender.ID
+	}
+
+	if userID != message.Sender.ID && !registry.Bot.IsAdmin(message.Chat, message.Sender) {
+		return 0, nil, "Only admins can change birthdays of others"
+	}
+
+	return userID, args, ""
+}
+
+func setCommand(message *telebot.Message, args []string) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	userID, args, problem := targetUser(message, args)
+	if problem != "" {
+		bot.Send(message.Chat, problem, options)
+		return
+	}
+
+	if len(args) != 1 {
+		bot.Send(message.Chat, "Usage: !др set 1990-05-12 or !др set 12.05", options)
+		return
+	}
+
+	month, day, year, ok := parseBirthday(args[0])
+	if !ok {
+		bot.Send(message.Chat, "That doesn't look like a date, try 1990-05-12 or 12.05", options)
+		return
+	}
+
+	if err := setBirthday(message.Chat.ID, userID, month, day, year, message.Sender.ID); err != nil {
+		log.Printf("Birthday: error saving birthday: %v", err)
+		return
 	}
+
+	ensureScheduled(message.Chat.ID)
+
+	bot.Send(message.Chat, fmt.Sprintf("Saved the birthday: %02d.%02d 🎂", day, int(month)), options)
+}
+
+func removeCommand(message *telebot.Message, args []string) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	userID, _, problem := targetUser(message, args)
+	if problem != "" {
+		bot.Send(message.Chat, problem, options)
+		return
+	}
+
+	removed, err := removeBirthday(message.Chat.ID, userID)
+	if err != nil {
+		log.Printf("Birthday: error removing birthday: %v", err)
+		return
+	}
+
+	if !removed {
+		bot.Send(message.Chat, "There was no birthday to remove", options)
+		return
+	}
+
+	bot.Send(message.Chat, "Removed the birthday", options)
+}
+
+// randomIndex picks a random index below n, announcements of chats run concurrently
+func randomIndex(n int) int {
+	rngMutex.Lock()
+	defer rngMutex.Unlock()
+
+	return rng.Intn(n)
+}
+
+// parseBirthday accepts 1990-05-12, 12.05.1990 and 12.05, year is zero when missing
+func parseBirthday(value string) (time.Month, int, int, bool) {
+	month, day, year, ok := parseDate(value)
+	if !ok || (year != 0 && (year < 1900 || year > time.Now().Year())) {
+		return 0, 0, 0, false
+	}
+
+	return month, day, year, true
 }
 
-func notMentioned(username string, year int, message *telebot.Message) bool {
+// parseDate accepts the birthday formats without limiting the year
+func parseDate(value string) (time.Month, int, int, bool) {
+	var day, month, year int
+
+	if match := isoDateExp.FindStringSubmatch(value); match != nil {
+		year, _ = strconv.Atoi(match[1])
+		month, _ = strconv.Atoi(match[2])
+		day, _ = strconv.Atoi(match[3])
+	} else if match := dotDateExp.FindStringSubmatch(value); match != nil {
+		day, _ = strconv.Atoi(match[1])
+		month, _ = strconv.Atoi(match[2])
+		year, _ = strconv.Atoi(match[4])
+	} else {
+		return 0, 0, 0, false
+	}
+
+	// A leap year accepts 29.02 when the year is unknown
+	checkYear := year
+	if checkYear == 0 {
+		checkYear = 2000
+	}
+
+	date := time.Date(checkYear, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Month() != time.Month(month) || date.Day() != day {
+		return 0, 0, 0, false
+	}
+
+	return time.Month(month), day, year, true
+}
+
+// mentioned reports whether the notification of the kind was already sent in the chat
+// this year, errors count as sent so nobody gets congratulated twice. Legacy rows
+// only know the username and count for every chat.
+func mentioned(chatID int64, b birthday, year int, kind string) bool {
 	var exists bool
 	err := database.DB.QueryRow(
-		"SELECT 1 FROM birthday_notifications WHERE username = ? AND year = ?",
-		username, year).Scan(&exists)
+		`SELECT 1 FROM birthday_notifications
+		WHERE year = ? AND kind = ? AND ((chat_id = ? AND user_id = ?) OR (chat_id IS NULL AND username = ?))
+		LIMIT 1`,
+		year, kind, chatID, b.userID, b.key()).Scan(&exists)
 
-	if err != nil {
-		log.Printf("Error checking birthday notifications: %v", err)
+	if err == sql.ErrNoRows {
 		return false
 	}
 
-	if exists {
-		return false
+	if err != nil {
+		log.Printf("Error checking birthday notifications: %v", err)
+		return true
 	}
 
-	log.Println("Birthday: notify " + username)
+	return exists
+}
 
-	_, err = database.DB.Exec(
-		"INSERT INTO birthday_notifications (username, year) VALUES (?, ?)",
-		username, year)
+func markMentioned(chatID int64, b birthday, year int, kind string) {
+	_, err := database.DB.Exec(
+		"INSERT OR IGNORE INTO birthday_notifications (chat_id, user_id, username, year, kind) VALUES (?, ?, ?, ?, ?)",
+		chatID, b.userID, b.username, year, kind)
 	if err != nil {
 		log.Printf("Error saving birthday notification: %v", err)
-		return false
+	}
+}
+
+// celebratedOn returns the date of the birthday in the given year,
+// 29 February is celebrated on the 28th in common years
+func celebratedOn(birthday time.Time, year int, loc *time.Location) time.Time {
+	if birthday.Month() == time.February && birthday.Day() == 29 && !isLeap(year) {
+		return time.Date(year, time.February, 28, 0, 0, 0, 0, loc)
+	}
+
+	return time.Date(year, birthday.Month(), birthday.Day(), 0, 0, 0, 0, loc)
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// nextOccurrence returns the closest date on or after today when the birthday is celebrated
+func nextOccurrence(birthday time.Time, today time.Time) time.Time {
+	next := celebratedOn(birthday, today.Year(), today.Location())
+	if next.Before(today) {
+		next = celebratedOn(birthday, today.Year()+1, today.Location())
+	}
+
+	return next
+}
+
+func upcomingBirthdaysTool(chatID int64, arguments string) (string, error) {
+	var args struct {
+		Days int `json:"days"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", err
+	}
+	if args.Days <= 0 || args.Days > 366 {
+		args.Days = 30
+	}
+
+	_, loc := chatSchedule(chatID)
+	cur := time.Now().In(loc)
+	today := time.Date(cur.Year(), cur.Month(), cur.Day(), 0, 0, 0, 0, loc)
+	until := today.AddDate(0, 0, args.Days)
+
+	type upcoming struct {
+		name string
+		date time.Time
+		age  int
+	}
+	var found []upcoming
+
+	for _, b := range chatBirthdays(chatID) {
+		next := nextOccurrence(b.date(loc), today)
+		if next.After(until) {
+			continue
+		}
+
+		turns := 0
+		if b.year != 0 {
+			turns = next.Year() - b.year
+		}
+		found = append(found, upcoming{b.name(), next, turns})
+	}
+
+	if len(found) == 0 {
+		return fmt.Sprintf("No birthdays in the next %d days", args.Days), nil
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].date.Before(found[j].date)
+	})
+
+	var result string
+	for _, b := range found {
+		if b.age != 0 {
+			result += fmt.Sprintf("%s: %s, turns %d\n", b.name, b.date.Format("02.01.2006"), b.age)
+		} else {
+			result += fmt.Sprintf("%s: %s\n", b.name, b.date.Format("02.01.2006"))
+		}
 	}
 
-	return true
+	return result, nil
 }
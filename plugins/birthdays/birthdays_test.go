@@ -0,0 +1,115 @@
+package birthdays
+
+import (
+	"testing"
+	"time"
+)
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestNextOccurrence(t *testing.T) {
+	tests := []struct {
+		birthday time.Time
+		today    time.Time
+		want     time.Time
+	}{
+		{day(1990, time.May, 12), day(2025, time.May, 1), day(2025, time.May, 12)},
+		{day(1990, time.May, 12), day(2025, time.May, 12), day(2025, time.May, 12)},
+		{day(1990, time.May, 12), day(2025, time.May, 13), day(2026, time.May, 12)},
+
+		// December to January
+		{day(1990, time.January, 2), day(2025, time.December, 30), day(2026, time.January, 2)},
+		{day(1990, time.December, 31), day(2025, time.December, 31), day(2025, time.December, 31)},
+		{day(1990, time.December, 31), day(2026, time.January, 1), day(2026, time.December, 31)},
+
+		// 29 February is celebrated on the 28th in common years
+		{day(2000, time.February, 29), day(2025, time.January, 10), day(2025, time.February, 28)},
+		{day(2000, time.February, 29), day(2027, time.March, 1), day(2028, time.February, 29)},
+		{day(0, time.February, 29), day(2028, time.February, 29), day(2028, time.February, 29)},
+	}
+
+	for _, test := range tests {
+		if got := nextOccurrence(test.birthday, test.today); !got.Equal(test.want) {
+			t.Errorf("nextOccurrence(%v, %v) = %v, want %v",
+				test.birthday.Format("2006-01-02"), test.today.Format("2006-01-02"),
+				got.Format("2006-01-02"), test.want.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestCelebratedOn(t *testing.T) {
+	leapDay := day(2000, time.February, 29)
+
+	tests := []struct {
+		year int
+		want time.Time
+	}{
+		{2024, day(2024, time.February, 29)},
+		{2025, day(2025, time.February, 28)},
+		{2100, day(2100, time.February, 28)},
+		{2400, day(2400, time.February, 29)},
+	}
+
+	for _, test := range tests {
+		if got := celebratedOn(leapDay, test.year, time.UTC); !got.Equal(test.want) {
+			t.Errorf("celebratedOn(29.02, %d) = %v, want %v", test.year, got, test.want)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value string
+		month time.Month
+		day   int
+		year  int
+		ok    bool
+	}{
+		{"12.05", time.May, 12, 0, true},
+		{"1.5.1990", time.May, 1, 1990, true},
+		{"1990-05-12", time.May, 12, 1990, true},
+
+		// 29.02 needs a leap year unless the year is unknown
+		{"29.02", time.February, 29, 0, true},
+		{"29.02.2000", time.February, 29, 2000, true},
+		{"29.02.2001", 0, 0, 0, false},
+		{"1900-02-29", 0, 0, 0, false},
+
+		{"31.04", 0, 0, 0, false},
+		{"12.13", 0, 0, 0, false},
+		{"May 12", 0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		month, d, year, ok := parseDate(test.value)
+		if month != test.month || d != test.day || year != test.year || ok != test.ok {
+			t.Errorf("parseDate(%q) = %v, %v, %v, %v, want %v, %v, %v, %v",
+				test.value, month, d, year, ok, test.month, test.day, test.year, test.ok)
+		}
+	}
+}
+
+func TestBirthdayEvent(t *testing.T) {
+	birthdays := []birthday{
+		{month: time.February, day: 29},
+		{month: time.February, day: 29, year: 2000},
+		{month: time.December, day: 31, year: 1990},
+		{month: time.January, day: 1},
+	}
+
+	for _, b := range birthdays {
+		e := b.event()
+		for today := day(2027, time.January, 1); today.Year() < 2029; today = today.AddDate(0, 0, 1) {
+			next := nextOccurrence(b.date(time.UTC), today)
+			if e.occursOn(today) != next.Equal(today) {
+				t.Errorf("%02d.%02d.%d: occursOn(%v) = %v", b.day, b.month, b.year, today.Format("2006-01-02"), e.occursOn(today))
+			}
+			if got := e.next(today); !got.Equal(next) {
+				t.Errorf("%02d.%02d.%d: next(%v) = %v, want %v", b.day, b.month, b.year,
+					today.Format("2006-01-02"), got.Format("2006-01-02"), next.Format("2006-01-02"))
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package birthdays
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type occurrence struct {
+	birthday
+	next time.Time
+}
+
+// upcomingOccurrences returns every birthday of the chat with its next
+// celebration on or after today, soonest first
+func upcomingOccurrences(chatID int64, today time.Time) []occurrence {
+	return occurrences(chatBirthdays(chatID), today)
+}
+
+func occurrences(birthdays []birthday, today time.Time) []occurrence {
+	var result []occurrence
+	for _, b := range birthdays {
+		result = append(result, occurrence{b, nextOccurrence(b.date(today.Location()), today)})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].next.Equal(result[j].next) {
+			return result[i].name() < result[j].name()
+		}
+		return result[i].next.Before(result[j].next)
+	})
+
+	return result
+}
+
+func chatToday(chatID int64) time.Time {
+	_, loc := chatSchedule(chatID)
+	cur := time.Now().In(loc)
+
+	return time.Date(cur.Year(), cur.Month(), cur.Day(), 0, 0, 0, 0, loc)
+}
+
+func (o occurrence) describe(today time.Time) string {
+	line := o.next.Format("02.01") + " " + o.name()
+
+	if o.year != 0 {
+		line += ", turns " + strconv.Itoa(o.next.Year()-o.year)
+	}
+
+	switch days := int(math.Round(o.next.Sub(today).Hours() / 24)); days {
+	case 0:
+		line += " — today! 🎂"
+	case 1:
+		line += " — tomorrow"
+	default:
+		line += fmt.Sprintf(" — in %d days", days)
+	}
+
+	return line
+}
+
+// listCommand shows all birthdays of the chat in the order they come
+func listCommand(message *telebot.Message) {
+	today := chatToday(message.Chat.ID)
+
+	occurrences := upcomingOccurrences(message.Chat.ID, today)
+	if len(occurrences) == 0 {
+		registry.Bot.Send(message.Chat, "No birthdays yet, add yours with !др set 12.05", &telebot.SendOptions{})
+		return
+	}
+
+	var lines []string
+	for _, o := range occurrences {
+		lines = append(lines, o.describe(today))
+	}
+
+	registry.Bot.Send(message.Chat, "Birthdays:\n"+strings.Join(lines, "\n"), &telebot.SendOptions{})
+}
+
+// monthCommand shows the birthdays of the current or the given month
+func monthCommand(message *telebot.Message, args []string) {
+	today := chatToday(message.Chat.ID)
+	month := today.Month()
+
+	if len(args) > 0 {
+		number, err := strconv.Atoi(args[0])
+		if err != nil || number < 1 || number > 12 {
+			registry.Bot.Send(message.Chat, "Usage: !др month 1-12", &telebot.SendOptions{ReplyTo: message})
+			return
+		}
+		month = time.Month(number)
+	}
+
+	var lines []string
+	for _, o := range inMonth(upcomingOccurrences(message.Chat.ID, today), month) {
+		lines = append(lines, o.describe(today))
+	}
+
+	if len(lines) == 0 {
+		registry.Bot.Send(message.Chat, "No birthdays in "+month.String(), &telebot.SendOptions{})
+		return
+	}
+
+	registry.Bot.Send(message.Chat, month.String()+":\n"+strings.Join(lines, "\n"), &telebot.SendOptions{})
+}
+
+// inMonth picks the occurrences of the month. Within a month the day order
+// matters more than the distance, days already past this month come next year.
+func inMonth(occurrences []occurrence, month time.Month) []occurrence {
+	var result []occurrence
+	for _, o := range occurrences {
+		if o.next.Month() == month {
+			result = append(result, o)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].next.Day() < result[j].next.Day()
+	})
+
+	return result
+}
+
+// exportCommand sends the birthdays of the chat as an iCalendar file
+func exportCommand(message *telebot.Message) {
+	birthdays := chatBirthdays(message.Chat.ID)
+	if len(birthdays) == 0 {
+		registry.Bot.Send(message.Chat, "No birthdays to export", &telebot.SendOptions{})
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "birthdays")
+	if err != nil {
+		log.Printf("Birthday: error creating export dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "birthdays.ics")
+	if err := os.WriteFile(path, []byte(iCalendar(message.Chat.ID, birthdays, time.Now())), 0644); err != nil {
+		log.Printf("Birthday: error writing export: %v", err)
+		return
+	}
+
+	document := &telebot.Document{
+		File:     telebot.FromDisk(path),
+		FileName: "birthdays.ics",
+		MIME:     "text/calendar",
+		Caption:  "Import into your calendar to never miss a birthday 🎂",
+	}
+
+	if _, err := registry.Bot.Send(message.Chat, document, &telebot.SendOptions{ReplyTo: message}); err != nil {
+		log.Printf("Birthday: error sending export: %v", err)
+	}
+}
+
+// iCalendar builds yearly all-day events, 29 February falls on the last day
+// of February in common years
+func iCalendar(chatID int64, birthdays []birthday, now time.Time) string {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//muxgoob//birthdays//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:Birthdays",
+	}
+
+	stamp := now.UTC().Format("20060102T150405Z")
+
+	for _, b := range birthdays {
+		year := b.year
+		if year == 0 {
+			year = 2000
+		}
+
+		rule := "RRULE:FREQ=YEARLY"
+		if b.month == time.February && b.day == 29 {
+			rule = "RRULE:FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1"
+		}
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%d-%d@muxgoob", chatID, b.userID),
+			"DTSTAMP:"+stamp,
+			fmt.Sprintf("DTSTART;VALUE=DATE:%04d%02d%02d", year, int(b.month), b.day),
+			rule,
+			"SUMMARY:"+escapeText("🎂 "+b.name()),
+			"TRANSP:TRANSPARENT",
+			"END:VEVENT",
+		)
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	for i, line := range lines {
+		lines[i] = foldLine(line)
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// foldLine breaks a content line longer than 75 octets, continuation lines
+// start with a space (RFC 5545, 3.1). Characters are never split.
+func foldLine(line string) string {
+	const limit = 75
+
+	var folded strings.Builder
+	width := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if width+size > limit {
+			folded.WriteString("\r\n ")
+			width = 1
+		}
+		folded.WriteRune(r)
+		width += size
+	}
+
+	return folded.String()
+}
+
+// escapeText escapes an iCalendar TEXT value
+func escapeText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
@@ -0,0 +1,104 @@
+package birthdays
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestInMonth(t *testing.T) {
+	birthdays := []birthday{
+		{userID: 1, username: "late", month: time.May, day: 25},
+		{userID: 2, username: "past", month: time.May, day: 3},
+		{userID: 3, username: "june", month: time.June, day: 1},
+		{userID: 4, username: "soon", month: time.May, day: 15},
+		{userID: 5, username: "also_soon", month: time.May, day: 15},
+	}
+
+	today := day(2025, time.May, 10)
+
+	var got []string
+	for _, o := range inMonth(occurrences(birthdays, today), time.May) {
+		got = append(got, o.next.Format("2006-01-02")+" "+o.username)
+	}
+
+	// Day order, even though the 3rd is next year
+	want := []string{
+		"2026-05-03 past",
+		"2025-05-15 also_soon",
+		"2025-05-15 soon",
+		"2025-05-25 late",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestICalendar(t *testing.T) {
+	birthdays := []birthday{
+		{userID: 7, username: "vasya", month: time.May, day: 12, year: 1990},
+		{userID: 8, firstName: "Leap, Day; Person", month: time.February, day: 29},
+		{userID: 9, firstName: strings.Repeat("Очень длинное имя ", 5), month: time.January, day: 1},
+	}
+
+	calendar := iCalendar(-100, birthdays, time.Date(2025, time.March, 4, 5, 6, 7, 0, time.UTC))
+
+	if !strings.HasSuffix(calendar, "END:VCALENDAR\r\n") {
+		t.Errorf("calendar doesn't end with END:VCALENDAR and CRLF")
+	}
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\n",
+		"UID:-100-7@muxgoob\r\nDTSTAMP:20250304T050607Z\r\nDTSTART;VALUE=DATE:19900512\r\nRRULE:FREQ=YEARLY\r\n",
+		"DTSTART;VALUE=DATE:20000229\r\nRRULE:FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1\r\n",
+		`SUMMARY:🎂 Leap\, Day\; Person` + "\r\n",
+	} {
+		if !strings.Contains(calendar, want) {
+			t.Errorf("calendar doesn't contain %q:\n%s", want, calendar)
+		}
+	}
+
+	// Long lines are folded without splitting characters
+	lines := strings.Split(strings.TrimSuffix(calendar, "\r\n"), "\r\n")
+	var summary string
+	for i, line := range lines {
+		if len(line) > 75 {
+			t.Errorf("line %d is %d octets long: %q", i, len(line), line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("line %d splits a character: %q", i, line)
+		}
+
+		if strings.HasPrefix(line, "SUMMARY:🎂 Очень") {
+			summary = line
+		} else if summary != "" && strings.HasPrefix(line, " ") {
+			summary += line[1:]
+		} else if summary != "" {
+			break
+		}
+	}
+
+	if want := "SUMMARY:🎂 " + strings.Repeat("Очень длинное имя ", 5); summary != want {
+		t.Errorf("got unfolded summary %q, want %q", summary, want)
+	}
+}
+
+func TestFoldLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"SHORT:line", "SHORT:line"},
+		{strings.Repeat("a", 75), strings.Repeat("a", 75)},
+		{strings.Repeat("a", 76), strings.Repeat("a", 75) + "\r\n a"},
+		{strings.Repeat("a", 160), strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 74) + "\r\n " + strings.Repeat("a", 11)},
+		{strings.Repeat("a", 74) + "я", strings.Repeat("a", 74) + "\r\n я"},
+	}
+
+	for _, test := range tests {
+		if got := foldLine(test.line); got != test.want {
+			t.Errorf("foldLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package birthdays
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// event is a recurring chat date that isn't tied to a member. Birthdays use
+// its date rules through birthday.event but keep their own table and
+// notifications: they belong to a member, get greetings and private reminders,
+// and are deduplicated per member with the legacy username rows.
+type event struct {
+	id         int64
+	chatID     int64
+	kind       string
+	recurrence string
+	title      string
+	text       string
+	year       int // zero when unknown
+	month      time.Month
+	day        int
+	weekday    time.Weekday
+	createdBy  int
+}
+
+// eventData is available to the announcement templates
+type eventData struct {
+	Title  string
+	Date   string
+	Count  int // whole periods since the start, zero when the start is unknown
+	Number int // which occurrence it is, zero when the start is unknown
+}
+
+// Default announcements of the event types
+var eventTypes = map[string]string{
+	"anniversary": `🎉 {{if .Count}}{{ordinal .Count}} anniversary{{else}}Anniversary{{end}} of {{.Title}} today!`,
+	"meetup":      `📅 {{.Title}} is today{{if .Number}}, the {{ordinal .Number}} one{{end}}!`,
+	"holiday":     `🥳 Happy {{.Title}}!`,
+	"event":       `📌 Today: {{.Title}}`,
+}
+
+var eventTemplateFuncs = template.FuncMap{"ordinal": ordinal}
+
+var eventExp = regexp.MustCompile(`(?is)^\!(events?|событи[ея])(\s+(.+))?$`)
+var eventAddExp = regexp.MustCompile(`(?is)^add\s+(\S+)\s+(\S+)\s+(\S+)\s+([^|]+?)\s*(\|\s*(.+))?$`)
+var dayOfMonthExp = regexp.MustCompile(`^\d{1,2}$`)
+
+var weekdays = map[string]time.Weekday{
+	"mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday,
+	"fri": time.Friday, "sat": time.Saturday, "sun": time.Sunday,
+	"пн": time.Monday, "вт": time.Tuesday, "ср": time.Wednesday, "чт": time.Thursday,
+	"пт": time.Friday, "сб": time.Saturday, "вс": time.Sunday,
+}
+
+// start is the first occurrence, in year zero when the year is unknown
+func (e event) start(loc *time.Location) time.Time {
+	return time.Date(e.year, e.month, e.day, 0, 0, 0, 0, loc)
+}
+
+// occursOn reports whether the event happens on the day
+func (e event) occursOn(day time.Time) bool {
+	if e.year != 0 && day.Before(e.start(day.Location())) {
+		return false
+	}
+
+	switch e.recurrence {
+	case "yearly":
+		return celebratedOn(e.start(day.Location()), day.Year(), day.Location()).Equal(day)
+	case "monthly":
+		// The 31st falls on the last day of shorter months
+		last := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+		if e.day > last {
+			return day.Day() == last
+		}
+		return day.Day() == e.day
+	case "weekly":
+		return day.Weekday() == e.weekday
+	}
+
+	return false
+}
+
+// next returns the closest day on or after today when the event happens
+func (e event) next(today time.Time) time.Time {
+	if e.recurrence == "yearly" && (e.year == 0 || !today.Before(e.start(today.Location()))) {
+		return nextOccurrence(e.start(today.Location()), today)
+	}
+
+	for day := today; day.Before(today.AddDate(1, 1, 0)); day = day.AddDate(0, 0, 1) {
+		if e.occursOn(day) {
+			return day
+		}
+	}
+
+	return time.Time{}
+}
+
+// count returns how many whole periods passed since the start
+func (e event) count(day time.Time) int {
+	if e.year == 0 {
+		return 0
+	}
+
+	start := e.start(day.Location())
+	switch e.recurrence {
+	case "yearly":
+		return day.Year() - start.Year()
+	case "monthly":
+		return (day.Year()-start.Year())*12 + int(day.Month()-start.Month())
+	case "weekly":
+		return int(day.Sub(start).Hours()+12) / 24 / 7
+	}
+
+	return 0
+}
+
+func (e event) announcement(day time.Time) string {
+	text := e.text
+	if text == "" {
+		text = eventTypes[e.kind]
+	}
+
+	data := eventData{Title: e.title, Date: day.Format("02.01")}
+	if e.year != 0 {
+		data.Count = e.count(day)
+		data.Number = data.Count + 1
+	}
+
+	result, err := renderEvent(text, data)
+	if err != nil {
+		log.Printf("Event: error rendering announcement of event %v: %v", e.id, err)
+		return "📌 Today: " + e.title
+	}
+
+	return result
+}
+
+func renderEvent(text string, data eventData) (string, error) {
+	tmpl, err := template.New("event").Funcs(eventTemplateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", err
+	}
+
+	return result.String(), nil
+}
+
+// ordinal spells 1 as 1st, 2 as 2nd and so on
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+
+	return strconv.Itoa(n) + suffix
+}
+
+// announceEvents posts the events of the chat happening on the day, yearly events
+// missed during downtime are announced late, the frequent ones are skipped
+func announceEvents(chatID int64, day time.Time) error {
+	cur := time.Now().In(day.Location())
+	belated := day.Before(time.Date(cur.Year(), cur.Month(), cur.Day(), 0, 0, 0, 0, cur.Location()))
+
+	for _, e := range chatEvents(chatID) {
+		if !e.occursOn(day) || (belated && e.recurrence != "yearly") || eventAnnounced(e.id, day) {
+			continue
+		}
+
+		log.Printf("Event: announce %v in chat %v", e.id, chatID)
+
+		text := e.announcement(day)
+		if belated {
+			text = "Belated, on " + day.Format("02.01") + ": " + text
+		}
+
+		if _, err := registry.Bot.Send(&telebot.Chat{ID: chatID}, text, &telebot.SendOptions{}); err != nil {
+			return err
+		}
+
+		markEventAnnounced(e.id, day)
+	}
+
+	return nil
+}
+
+func chatEvents(chatID int64) []event {
+	rows, err := database.DB.Query(
+		`SELECT id, chat_id, type, recurrence, title, COALESCE(text, ''), COALESCE(year, 0),
+			COALESCE(month, 0), COALESCE(day, 0), COALESCE(weekday, 0), created_by
+		FROM events WHERE chat_id = ? ORDER BY id`,
+		chatID)
+	if err != nil {
+		log.Printf("Event: error loading events: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []event
+	for rows.Next() {
+		var e event
+		var month, weekday int
+		err := rows.Scan(&e.id, &e.chatID, &e.kind, &e.recurrence, &e.title, &e.text, &e.year,
+			&month, &e.day, &weekday, &e.createdBy)
+		if err != nil {
+			log.Printf("Event: error scanning event: %v", err)
+			continue
+		}
+		e.month = time.Month(month)
+		e.weekday = time.Weekday(weekday)
+		result = append(result, e)
+	}
+
+	return result
+}
+
+// eventAnnounced reports whether the event was already announced on the day,
+// errors count as announced so nothing is posted twice
+func eventAnnounced(eventID int64, day time.Time) bool {
+	var exists bool
+	err := database.DB.QueryRow(
+		"SELECT 1 FROM event_notifications WHERE event_id = ? AND date = ?",
+		eventID, day.Format("2006-01-02")).Scan(&exists)
+
+	if err == sql.ErrNoRows {
+		return false
+	}
+
+	if err != nil {
+		log.Printf("Event: error checking notifications: %v", err)
+		return true
+	}
+
+	return exists
+}
+
+func markEventAnnounced(eventID int64, day time.Time) {
+	_, err := database.DB.Exec(
+		"INSERT OR IGNORE INTO event_notifications (event_id, date) VALUES (?, ?)",
+		eventID, day.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Event: error saving notification: %v", err)
+	}
+}
+
+func handleEventCommand(message *telebot.Message) {
+	match := eventExp.FindStringSubmatch(message.Text)
+	if match == nil {
+		return
+	}
+
+	args := strings.TrimSpace(match[3])
+	fields := strings.Fields(args)
+
+	switch {
+	case len(fields) == 0 || strings.EqualFold(fields[0], "list"):
+		eventListCommand(message)
+	case strings.EqualFold(fields[0], "add"):
+		eventAddCommand(message, args)
+	case strings.EqualFold(fields[0], "remove") || strings.EqualFold(fields[0], "delete"):
+		eventRemoveCommand(message, fields[1:])
+	}
+}
+
+const eventUsage = "Usage: !event add <type> <yearly|monthly|weekly> <date> <title> [| announcement]\n" +
+	"Types: anniversary, meetup, holiday, event. Dates: 2019-03-15, 15.03, 15 for monthly, wed for weekly.\n" +
+	"The announcement may use {{.Title}}, {{.Date}}, {{.Count}}, {{.Number}} and {{ordinal .Count}}."
+
+func eventAddCommand(message *telebot.Message, args string) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	match := eventAddExp.FindStringSubmatch(args)
+	if match == nil {
+		bot.Send(message.Chat, eventUsage, options)
+		return
+	}
+
+	e := event{
+		chatID:     message.Chat.ID,
+		kind:       strings.ToLower(match[1]),
+		recurrence: strings.ToLower(match[2]),
+		title:      strings.TrimSpace(match[4]),
+		text:       strings.TrimSpace(match[6]),
+		createdBy:  message.Sender.ID,
+	}
+
+	if _, ok := eventTypes[e.kind]; !ok {
+		bot.Send(message.Chat, "Unknown event type "+e.kind+", try anniversary, meetup, holiday or event", options)
+		return
+	}
+
+	if !parseEventDate(&e, match[3]) {
+		bot.Send(message.Chat, eventUsage, options)
+		return
+	}
+
+	if e.text != "" {
+		if _, err := renderEvent(e.text, eventData{Title: e.title, Count: 1, Number: 2}); err != nil {
+			bot.Send(message.Chat, "The announcement template is broken: "+err.Error(), options)
+			return
+		}
+	}
+
+	var yearValue interface{}
+	if e.year != 0 {
+		yearValue = e.year
+	}
+
+	result, err := database.DB.Exec(
+		`INSERT INTO events (chat_id, type, recurrence, title, text, year, month, day, weekday, created_by, unixtime)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.chatID, e.kind, e.recurrence, e.title, e.text, yearValue, int(e.month), e.day, int(e.weekday),
+		e.createdBy, time.Now().Unix())
+	if err != nil {
+		log.Printf("Event: error saving event: %v", err)
+		return
+	}
+	e.id, _ = result.LastInsertId()
+
+	ensureScheduled(message.Chat.ID)
+
+	today := chatToday(message.Chat.ID)
+	bot.Send(message.Chat, fmt.Sprintf("Saved event #%d, next time on %s", e.id, e.next(today).Format("02.01.2006")), options)
+}
+
+// parseEventDate fills the start of the event, yearly events take a date,
+// monthly ones also a day of month and weekly ones also a weekday
+func parseEventDate(e *event, value string) bool {
+	switch e.recurrence {
+	case "yearly", "monthly", "weekly":
+	default:
+		return false
+	}
+
+	if month, day, year, ok := parseDate(value); ok {
+		e.month, e.day, e.year = month, day, year
+		e.weekday = time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday()
+
+		// A weekday is meaningless without the year
+		return e.recurrence != "weekly" || year != 0
+	}
+
+	switch e.recurrence {
+	case "monthly":
+		if !dayOfMonthExp.MatchString(value) {
+			return false
+		}
+		e.day, _ = strconv.Atoi(value)
+		e.month = time.January
+		return e.day >= 1 && e.day <= 31
+	case "weekly":
+		weekday, ok := weekdays[strings.ToLower(value)]
+		e.weekday = weekday
+		e.month, e.day = time.January, 1
+		return ok
+	}
+
+	return false
+}
+
+// eventListCommand shows the events of the chat with their next dates
+func eventListCommand(message *telebot.Message) {
+	events := chatEvents(message.Chat.ID)
+	if len(events) == 0 {
+		registry.Bot.Send(message.Chat, "No events yet\n\n"+eventUsage, &telebot.SendOptions{})
+		return
+	}
+
+	today := chatToday(message.Chat.ID)
+
+	var lines []string
+	for _, e := range events {
+		next := e.next(today)
+		line := fmt.Sprintf("#%d %s, %s %s, next on %s", e.id, e.title, e.recurrence, e.kind, next.Format("02.01.2006"))
+		if e.year != 0 && e.count(next) > 0 {
+			line += fmt.Sprintf(" (%s)", ordinal(e.count(next)))
+		}
+		lines = append(lines, line)
+	}
+
+	registry.Bot.Send(message.Chat, "Events:\n"+strings.Join(lines, "\n"), &telebot.SendOptions{})
+}
+
+// eventRemoveCommand deletes an event, only its author and admins can do it
+func eventRemoveCommand(message *telebot.Message, args []string) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	if len(args) != 1 {
+		bot.Send(message.Chat, "Usage: !event remove <id>", options)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+	if err != nil {
+		bot.Send(message.Chat, "Usage: !event remove <id>", options)
+		return
+	}
+
+	var createdBy int
+	err = database.DB.QueryRow(
+		"SELECT created_by FROM events WHERE id = ? AND chat_id = ?",
+		id, message.Chat.ID).Scan(&createdBy)
+	if err == sql.ErrNoRows {
+		bot.Send(message.Chat, "There is no such event", options)
+		return
+	}
+	if err != nil {
+		log.Printf("Event: error loading event: %v", err)
+		return
+	}
+
+	if createdBy != message.Sender.ID && !bot.IsAdmin(message.Chat, message.Sender) {
+		bot.Send(message.Chat, "Only the author and admins can remove the event", options)
+		return
+	}
+
+	_, err = database.DB.Exec("DELETE FROM events WHERE id = ?", id)
+	if err != nil {
+		log.Printf("Event: error removing event: %v", err)
+		return
+	}
+
+	database.DB.Exec("DELETE FROM event_notifications WHERE event_id = ?", id)
+
+	bot.Send(message.Chat, "Removed the event", options)
+}
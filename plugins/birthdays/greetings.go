@@ -0,0 +1,216 @@
+package birthdays
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bearbin/go-age"
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/markup"
+	"github.com/focusshifter/muxgoob/moderation"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// greetingData is available to the greeting templates, Name is an HTML mention
+type greetingData struct {
+	Name    string
+	Age     int // zero when the year is unknown
+	Date    string
+	Belated bool
+}
+
+const defaultGreeting = `{{if .Belated}}Belated hooray! 🎉 {{.Name}} {{if .Age}}turned {{.Age}}{{else}}had a birthday{{end}} on {{.Date}}! 🎂` +
+	`{{else}}Hooray! 🎉 {{.Name}} {{if .Age}}is turning {{.Age}}{{else}}has a birthday today{{end}}! 🎂{{end}}`
+
+const greetingPrompt = `You write a short, warm and personal birthday greeting for a member of a group chat.
+Use the language the member writes in. Refer to their interests from the recent messages if there are any,
+but don't quote them. Write {name} where the member's name goes. Two or three sentences, a couple of emoji, no hashtags.`
+
+// greetingConfig returns the greeting settings of the chat
+func greetingConfig(chatID int64) registry.BirthdayConfig {
+	var result registry.BirthdayConfig
+	for _, config := range registry.Config.Birthdays {
+		if config.ChatID == chatID {
+			result = config
+		}
+	}
+
+	return result
+}
+
+// mention links the member by ID so it works without a username
+func (b birthday) mention() string {
+	name := b.firstName
+	if name == "" {
+		name = b.name()
+	}
+
+	if b.userID == 0 {
+		return markup.Escape(name)
+	}
+
+	return fmt.Sprintf(`<a href="tg://user?id=%d">%s</a>`, b.userID, markup.Escape(name))
+}
+
+// sendGreeting congratulates the member with an AI greeting or one of the chat templates
+// and an optional sticker or GIF
+func sendGreeting(chatID int64, b birthday, day time.Time, belated bool) error {
+	bot := registry.Bot
+	chat := &telebot.Chat{ID: chatID}
+	config := greetingConfig(chatID)
+
+	data := greetingData{
+		Name:    b.mention(),
+		Date:    day.Format("02.01"),
+		Belated: belated,
+	}
+	if b.year != 0 {
+		data.Age = age.AgeAt(b.date(day.Location()), day)
+	}
+
+	var text string
+	if config.AiGreeting && !belated {
+		text = aiGreeting(chatID, b, data)
+	}
+	if text == "" {
+		text = templateGreeting(config.Greetings, data)
+	}
+
+	if _, err := bot.Send(chat, text, &telebot.SendOptions{ParseMode: telebot.ModeHTML}); err != nil {
+		log.Printf("Birthday: error sending greeting, falling back to the default: %v", err)
+
+		data.Name = b.name()
+		if _, err := bot.Send(chat, templateGreeting(nil, data), &telebot.SendOptions{}); err != nil {
+			return err
+		}
+	}
+
+	sendGreetingMedia(chat, config)
+
+	return nil
+}
+
+// templateGreeting renders a random template of the pool, the default one when the pool is empty
+func templateGreeting(templates []string, data greetingData) string {
+	text := defaultGreeting
+	if len(templates) > 0 {
+		text = templates[randomIndex(len(templates))]
+	}
+
+	tmpl, err := template.New("greeting").Parse(text)
+	if err != nil {
+		log.Printf("Birthday: error parsing greeting template: %v", err)
+		tmpl = template.Must(template.New("greeting").Parse(defaultGreeting))
+	}
+
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		log.Printf("Birthday: error rendering greeting template: %v", err)
+		return data.Name + " 🎂"
+	}
+
+	return result.String()
+}
+
+// aiGreeting writes a personal greeting from the member's recent messages,
+// an empty result means the template should be used instead
+func aiGreeting(chatID int64, b birthday, data greetingData) string {
+	call := ai.Call{ChatID: chatID, UserID: b.userID, Purpose: "birthday"}
+
+	var request strings.Builder
+	if data.Age != 0 {
+		fmt.Fprintf(&request, "The member turns %d today.\n", data.Age)
+	}
+	if recent := recentMessages(chatID, b.userID, 30); len(recent) > 0 {
+		request.WriteString("Their recent messages:\n")
+		for _, line := range recent {
+			request.WriteString("- " + line + "\n")
+		}
+	} else {
+		request.WriteString("There are no recent messages of the member.\n")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	greeting, err := ai.Ask(ctx, call, greetingPrompt, request.String())
+	if err != nil {
+		return ""
+	}
+
+	greeting, ok := moderation.Review(call, "output", strings.TrimSpace(greeting))
+	if !ok || greeting == "" {
+		return ""
+	}
+
+	text := markup.ToHTML(greeting)
+	if !strings.Contains(text, "{name}") {
+		return data.Name + ", " + text
+	}
+
+	return strings.ReplaceAll(text, "{name}", data.Name)
+}
+
+// recentMessages returns up to limit latest texts of the member in the chat, oldest first
+func recentMessages(chatID int64, userID int, limit int) []string {
+	rows, err := database.DB.Query(
+		`SELECT COALESCE(NULLIF(text, ''), caption, '') FROM messages
+		WHERE chat_id = ? AND sender_id = ? AND COALESCE(NULLIF(text, ''), caption, '') != ''
+		ORDER BY unixtime DESC LIMIT ?`,
+		chatID, userID, limit)
+	if err != nil {
+		log.Printf("Birthday: error loading recent messages: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			log.Printf("Birthday: error scanning message: %v", err)
+			continue
+		}
+		if strings.HasPrefix(text, "!") {
+			continue
+		}
+		result = append([]string{text}, result...)
+	}
+
+	return result
+}
+
+// sendGreetingMedia sends a random sticker or GIF from the chat pools
+func sendGreetingMedia(chat *telebot.Chat, config registry.BirthdayConfig) {
+	total := len(config.Stickers) + len(config.Animations)
+	if total == 0 {
+		return
+	}
+
+	var what interface{}
+	if i := randomIndex(total); i < len(config.Stickers) {
+		what = &telebot.Sticker{File: telebot.File{FileID: config.Stickers[i]}}
+	} else {
+		what = &telebot.Document{File: mediaFile(config.Animations[i-len(config.Stickers)])}
+	}
+
+	if _, err := registry.Bot.Send(chat, what, &telebot.SendOptions{}); err != nil {
+		log.Printf("Birthday: error sending greeting media: %v", err)
+	}
+}
+
+// mediaFile accepts a Telegram file ID or a URL
+func mediaFile(value string) telebot.File {
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		return telebot.File{FileURL: value}
+	}
+
+	return telebot.File{FileID: value}
+}
@@ -0,0 +1,166 @@
+package birthdays
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+const birthdayKind = "birthday"
+
+// chatReminders returns how many days in advance the chat is reminded
+// and whether reminders go to the chat or privately to subscribers
+func chatReminders(chatID int64) ([]int, string) {
+	days := registry.Config.BirthdayReminders
+	to := "chat"
+
+	for _, config := range registry.Config.Birthdays {
+		if config.ChatID != chatID {
+			continue
+		}
+
+		if config.Reminders != nil {
+			days = config.Reminders
+		}
+
+		if config.RemindersTo != "" {
+			to = config.RemindersTo
+		}
+	}
+
+	return days, to
+}
+
+// remindBirthdays warns about the birthdays coming in the configured number of days,
+// reminders for birthdays that already passed during downtime are skipped
+func remindBirthdays(chatID int64, day time.Time) error {
+	days, to := chatReminders(chatID)
+	if len(days) == 0 {
+		return nil
+	}
+
+	cur := time.Now().In(day.Location())
+	today := time.Date(cur.Year(), cur.Month(), cur.Day(), 0, 0, 0, 0, cur.Location())
+
+	for _, b := range chatBirthdays(chatID) {
+		for _, n := range days {
+			if n <= 0 {
+				continue
+			}
+
+			target := day.AddDate(0, 0, n)
+			kind := "remind_" + strconv.Itoa(n)
+
+			if target.Before(today) ||
+				!b.event().occursOn(target) ||
+				mentioned(chatID, b, target.Year(), kind) {
+				continue
+			}
+
+			log.Printf("Birthday: remind about %v in %d days", b.key(), n)
+
+			text := reminderText(b, target, today)
+			if to == "private" {
+				sendPrivateReminder(chatID, b, text)
+			} else if _, err := registry.Bot.Send(&telebot.Chat{ID: chatID}, text, &telebot.SendOptions{}); err != nil {
+				return err
+			}
+
+			markMentioned(chatID, b, target.Year(), kind)
+		}
+	}
+
+	return nil
+}
+
+func reminderText(b birthday, target time.Time, today time.Time) string {
+	left := int(target.Sub(today).Hours()+12) / 24
+
+	var when string
+	switch left {
+	case 0:
+		when = "today"
+	case 1:
+		when = "tomorrow"
+	default:
+		when = fmt.Sprintf("in %d days, on %s", left, target.Format("02.01"))
+	}
+
+	if b.year != 0 {
+		return fmt.Sprintf("Heads up: %s turns %d %s 🎁 Time to organize a gift!", b.name(), target.Year()-b.year, when)
+	}
+
+	return fmt.Sprintf("Heads up: %s has a birthday %s 🎁 Time to organize a gift!", b.name(), when)
+}
+
+// sendPrivateReminder messages the subscribers of the chat except the birthday person,
+// members who never started a private chat with the bot can't be reached
+func sendPrivateReminder(chatID int64, b birthday, text string) {
+	for _, userID := range reminderSubscribers(chatID) {
+		if userID == b.userID {
+			continue
+		}
+
+		if _, err := registry.Bot.Send(&telebot.User{ID: userID}, text, &telebot.SendOptions{}); err != nil {
+			log.Printf("Birthday: error sending reminder to %v: %v", userID, err)
+		}
+	}
+}
+
+func reminderSubscribers(chatID int64) []int {
+	rows, err := database.DB.Query(
+		"SELECT user_id FROM birthday_reminder_subscriptions WHERE chat_id = ?",
+		chatID)
+	if err != nil {
+		log.Printf("Birthday: error loading reminder subscriptions: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			log.Printf("Birthday: error scanning reminder subscription: %v", err)
+			continue
+		}
+		result = append(result, userID)
+	}
+
+	return result
+}
+
+// remindCommand subscribes the sender to private reminders about the chat birthdays
+func remindCommand(message *telebot.Message, args []string) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	var query, text string
+	switch {
+	case len(args) == 1 && strings.EqualFold(args[0], "on"):
+		query = "INSERT OR IGNORE INTO birthday_reminder_subscriptions (chat_id, user_id) VALUES (?, ?)"
+		text = "You will get birthday reminders in private messages, make sure you've started a chat with me"
+	case len(args) == 1 && strings.EqualFold(args[0], "off"):
+		query = "DELETE FROM birthday_reminder_subscriptions WHERE chat_id = ? AND user_id = ?"
+		text = "No more birthday reminders for you"
+	default:
+		bot.Send(message.Chat, "Usage: !др remind on or !др remind off", options)
+		return
+	}
+
+	if _, err := database.DB.Exec(query, message.Chat.ID, message.Sender.ID); err != nil {
+		log.Printf("Birthday: error saving reminder subscription: %v", err)
+		return
+	}
+
+	ensureScheduled(message.Chat.ID)
+
+	bot.Send(message.Chat, text, options)
+}
@@ -0,0 +1,233 @@
+package birthdays
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type birthday struct {
+	userID    int
+	username  string
+	firstName string
+	month     time.Month
+	day       int
+	year      int // zero when unknown
+}
+
+// name is how the member is mentioned in the chat
+func (b birthday) name() string {
+	if b.username != "" {
+		return "@" + b.username
+	}
+	if b.firstName != "" {
+		return b.firstName
+	}
+
+	return "#" + strconv.Itoa(b.userID)
+}
+
+// key identifies the member in the legacy birthday_notifications rows,
+// which were keyed by username
+func (b birthday) key() string {
+	if b.username != "" {
+		return b.username
+	}
+
+	return "#" + strconv.Itoa(b.userID)
+}
+
+// date is the birth date, in year zero when the year is unknown
+func (b birthday) date(loc *time.Location) time.Time {
+	return time.Date(b.year, b.month, b.day, 0, 0, 0, 0, loc)
+}
+
+// event is the birthday as a yearly event, so both follow the same date rules
+func (b birthday) event() event {
+	return event{recurrence: "yearly", year: b.year, month: b.month, day: b.day}
+}
+
+// chatBirthdays returns the birthdays registered in the chat
+func chatBirthdays(chatID int64) []birthday {
+	rows, err := database.DB.Query(
+		`SELECT b.user_id, COALESCE(u.username, ''), COALESCE(u.first_name, ''), b.month, b.day, COALESCE(b.year, 0)
+		FROM birthdays b
+		LEFT JOIN users u ON u.id = b.user_id
+		WHERE b.chat_id = ?`,
+		chatID)
+	if err != nil {
+		log.Printf("Birthday: error loading birthdays: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []birthday
+	for rows.Next() {
+		var b birthday
+		var month int
+		if err := rows.Scan(&b.userID, &b.username, &b.firstName, &month, &b.day, &b.year); err != nil {
+			log.Printf("Birthday: error scanning birthday: %v", err)
+			continue
+		}
+		b.month = time.Month(month)
+		result = append(result, b)
+	}
+
+	return result
+}
+
+// birthdayChats returns the chats that have birthdays or events in the database
+func birthdayChats() []int64 {
+	rows, err := database.DB.Query("SELECT chat_id FROM birthdays UNION SELECT chat_id FROM events")
+	if err != nil {
+		log.Printf("Birthday: error loading chats: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var chats []int64
+	for rows.Next() {
+		var chatID int64
+		if err := rows.Scan(&chatID); err == nil {
+			chats = append(chats, chatID)
+		}
+	}
+
+	return chats
+}
+
+func setBirthday(chatID int64, userID int, month time.Month, day int, year int, setBy int) error {
+	var yearValue interface{}
+	if year != 0 {
+		yearValue = year
+	}
+
+	_, err := database.DB.Exec(
+		"INSERT OR REPLACE INTO birthdays (chat_id, user_id, month, day, year, set_by, unixtime) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		chatID, userID, int(month), day, yearValue, setBy, time.Now().Unix())
+
+	return err
+}
+
+// removeBirthday deletes the birthday and reports whether there was one
+func removeBirthday(chatID int64, userID int) (bool, error) {
+	result, err := database.DB.Exec("DELETE FROM birthdays WHERE chat_id = ? AND user_id = ?", chatID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	removed, _ := result.RowsAffected()
+	return removed > 0, nil
+}
+
+// userByUsername looks up a member the bot has seen
+func userByUsername(username string) (int, bool) {
+	var userID int
+	err := database.DB.QueryRow(
+		"SELECT id FROM users WHERE username = ? COLLATE NOCASE",
+		strings.TrimPrefix(username, "@")).Scan(&userID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Birthday: error looking up %v: %v", username, err)
+		}
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// Config birthdays of members the bot hasn't seen yet, by lowercase username
+var pendingImports = map[string][]pendingImport{}
+var pendingImportsMutex sync.Mutex
+
+type pendingImport struct {
+	chatID   int64
+	username string
+	date     time.Time
+}
+
+// importConfigBirthdays copies config birthdays to the database once.
+// Members the bot hasn't seen yet are imported when they first write.
+func importConfigBirthdays() {
+	for _, config := range registry.Config.Birthdays {
+		for username, value := range config.Users {
+			var imported bool
+			err := database.DB.QueryRow(
+				"SELECT 1 FROM birthday_imports WHERE chat_id = ? AND username = ?",
+				config.ChatID, username).Scan(&imported)
+			if err == nil {
+				continue
+			}
+
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				log.Printf("Birthday: bad date %v for %v: %v", value, username, err)
+				continue
+			}
+
+			userID, ok := userByUsername(username)
+			if !ok {
+				log.Printf("Birthday: %v hasn't been seen yet, importing on their first message", username)
+
+				key := strings.ToLower(strings.TrimPrefix(username, "@"))
+				pendingImportsMutex.Lock()
+				pendingImports[key] = append(pendingImports[key], pendingImport{config.ChatID, username, date})
+				pendingImportsMutex.Unlock()
+				continue
+			}
+
+			importBirthday(config.ChatID, username, userID, date)
+		}
+	}
+}
+
+// importPending imports the config birthdays waiting for the sender to show up
+func importPending(sender *telebot.User) {
+	if sender == nil || sender.Username == "" {
+		return
+	}
+
+	key := strings.ToLower(sender.Username)
+
+	pendingImportsMutex.Lock()
+	pending, ok := pendingImports[key]
+	delete(pendingImports, key)
+	pendingImportsMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, p := range pending {
+		importBirthday(p.chatID, p.username, sender.ID, p.date)
+		ensureScheduled(p.chatID)
+	}
+}
+
+func importBirthday(chatID int64, username string, userID int, date time.Time) {
+	// Birthdays set with commands take precedence
+	_, err := database.DB.Exec(
+		"INSERT OR IGNORE INTO birthdays (chat_id, user_id, month, day, year, set_by, unixtime) VALUES (?, ?, ?, ?, ?, 0, ?)",
+		chatID, userID, int(date.Month()), date.Day(), date.Year(), time.Now().Unix())
+	if err != nil {
+		log.Printf("Birthday: error importing %v: %v", username, err)
+		return
+	}
+
+	_, err = database.DB.Exec(
+		"INSERT INTO birthday_imports (chat_id, username) VALUES (?, ?)",
+		chatID, username)
+	if err != nil {
+		log.Printf("Birthday: error marking %v imported: %v", username, err)
+	}
+
+	log.Printf("Birthday: imported %v from the config", username)
+}
@@ -0,0 +1,263 @@
+package dupelink
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type rewrite struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+type rule struct {
+	registry.DupeRuleConfig
+	path     *regexp.Regexp
+	rewrites []rewrite
+}
+
+// Tracking parameters dropped from every link
+var trackingParams = []string{"utm_*", "fbclid", "gclid", "yclid", "igshid", "mc_cid", "mc_eid", "_ga"}
+
+var youtubeHosts = []string{"youtube.com", "m.youtube.com", "music.youtube.com", "youtube-nocookie.com"}
+var twitterHosts = []string{"twitter.com", "x.com", "mobile.twitter.com", "fxtwitter.com", "vxtwitter.com", "fixupx.com"}
+var redditHosts = []string{"reddit.com", "old.reddit.com", "new.reddit.com", "np.reddit.com", "m.reddit.com"}
+
+var builtinRules = []registry.DupeRuleConfig{
+	{
+		Hosts:    []string{"youtu.be"},
+		Host:     "youtube.com",
+		Rewrites: []registry.DupeRewriteConfig{{Pattern: `^/([\w-]+)$`, Replace: "/watch?v=$1"}},
+	},
+	{
+		Hosts: youtubeHosts,
+		Host:  "youtube.com",
+		Rewrites: []registry.DupeRewriteConfig{
+			{Pattern: `^/(shorts|embed|live|v)/([\w-]+)$`, Replace: "/watch?v=$2"},
+		},
+	},
+	{Hosts: []string{"youtube.com"}, Path: `^/watch$`, KeepParams: []string{"v"}},
+	{Hosts: []string{"youtube.com"}, Path: `^/playlist$`, KeepParams: []string{"list"}},
+	{
+		Hosts: twitterHosts,
+		Host:  "x.com",
+		// The status ID is enough and survives renames
+		Rewrites:    []registry.DupeRewriteConfig{{Pattern: `^/[^/]+/status(es)?/(\d+).*$`, Replace: "/i/status/$2"}},
+		StripParams: []string{"*"},
+	},
+	{
+		Hosts:       []string{"redd.it"},
+		Host:        "reddit.com",
+		Rewrites:    []registry.DupeRewriteConfig{{Pattern: `^/(\w+)$`, Replace: "/comments/$1"}},
+		StripParams: []string{"*"},
+	},
+	{
+		Hosts: redditHosts,
+		Host:  "reddit.com",
+		Rewrites: []registry.DupeRewriteConfig{
+			{Pattern: `^/r/[^/]+/comments/(\w+)(/[^/]*)?/?$`, Replace: "/comments/$1"},
+		},
+		StripParams: []string{"*"},
+	},
+	{
+		Hosts:       []string{"open.spotify.com"},
+		Rewrites:    []registry.DupeRewriteConfig{{Pattern: `^/intl-[\w-]+/`, Replace: "/"}},
+		StripParams: []string{"*"},
+	},
+	{
+		Hosts:       []string{"instagram.com"},
+		Rewrites:    []registry.DupeRewriteConfig{{Pattern: `^/(?:[\w.]+/)?(?:p|reels?|tv)/([\w-]+).*$`, Replace: "/p/$1"}},
+		StripParams: []string{"*"},
+	},
+	{
+		Hosts: []string{"tiktok.com", "m.tiktok.com"},
+		Host:  "tiktok.com",
+		Rewrites: []registry.DupeRewriteConfig{
+			{Pattern: `^/@[^/]+/video/(\d+).*$`, Replace: "/video/$1"},
+			{Pattern: `^/v/(\d+)(\.html)?$`, Replace: "/video/$1"},
+		},
+		StripParams: []string{"*"},
+	},
+	{StripParams: trackingParams},
+}
+
+var rules []rule
+var rulesOnce sync.Once
+
+// loadRules compiles the config rules followed by the built-in ones,
+// so the config can alias a host to one the built-in rules know
+func loadRules() []rule {
+	rulesOnce.Do(func() {
+		for _, config := range append(append([]registry.DupeRuleConfig{}, registry.Config.DupeRules...), builtinRules...) {
+			r, err := compileRule(config)
+			if err != nil {
+				log.Printf("Dupe: skipping rule for %v: %v", config.Hosts, err)
+				continue
+			}
+			rules = append(rules, r)
+		}
+	})
+
+	return rules
+}
+
+func compileRule(config registry.DupeRuleConfig) (rule, error) {
+	r := rule{DupeRuleConfig: config}
+
+	if config.Path != "" {
+		path, err := regexp.Compile(config.Path)
+		if err != nil {
+			return r, err
+		}
+		r.path = path
+	}
+
+	for _, rw := range config.Rewrites {
+		pattern, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			return r, err
+		}
+		r.rewrites = append(r.rewrites, rewrite{pattern, rw.Replace})
+	}
+
+	return r, nil
+}
+
+func (r rule) matches(host string, path string) bool {
+	if r.path != nil && !r.path.MatchString(path) {
+		return false
+	}
+
+	if len(r.Hosts) == 0 {
+		return true
+	}
+
+	for _, h := range r.Hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalURL turns the link into its canonical key: host without www,
+// path without the trailing slash and the query after every matching rule
+func canonicalURL(parsedURL *url.URL) string {
+	host := strings.TrimPrefix(strings.ToLower(parsedURL.Hostname()), "www.")
+	// Rewrites expect paths without the trailing slash
+	path := strings.TrimRight(parsedURL.EscapedPath(), "/")
+	query := parsedURL.Query()
+
+	for _, r := range loadRules() {
+		if !r.matches(host, path) {
+			continue
+		}
+
+		if r.Host != "" {
+			host = r.Host
+		}
+
+		for _, rw := range r.rewrites {
+			if !rw.pattern.MatchString(path) {
+				continue
+			}
+
+			path = rw.pattern.ReplaceAllString(path, rw.replace)
+			if i := strings.Index(path, "?"); i >= 0 {
+				added, _ := url.ParseQuery(path[i+1:])
+				for name, values := range added {
+					query[name] = values
+				}
+				path = path[:i]
+			}
+		}
+
+		for name := range query {
+			if (len(r.KeepParams) > 0 && !paramListed(r.KeepParams, name)) || paramListed(r.StripParams, name) {
+				query.Del(name)
+			}
+		}
+	}
+
+	path = strings.TrimRight(path, "/")
+	if len(query) > 0 {
+		return host + path + "?" + query.Encode()
+	}
+
+	return host + path
+}
+
+// paramListed reports whether the parameter is in the list, "utm_*" matches by prefix
+func paramListed(list []string, name string) bool {
+	for _, pattern := range list {
+		if pattern == name || pattern == "*" ||
+			(strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recanonicalizeLinks updates the stored keys after the rules change,
+// so links saved before keep matching their new posts
+func recanonicalizeLinks() {
+	rows, err := database.DB.Query("SELECT id, url FROM dupe_links")
+	if err != nil {
+		log.Printf("Dupe: error loading links: %v", err)
+		return
+	}
+
+	updates := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			log.Printf("Dupe: error scanning link: %v", err)
+			continue
+		}
+
+		// Forwarded posts aren't links
+		if strings.HasPrefix(key, "forward:") {
+			continue
+		}
+
+		parsedURL, err := url.Parse("https://" + key)
+		if err != nil {
+			continue
+		}
+
+		if canonical := canonicalURL(parsedURL); canonical != key {
+			updates[id] = canonical
+		}
+	}
+	rows.Close()
+
+	if len(updates) == 0 {
+		return
+	}
+
+	err = database.WithTx(context.Background(), func(tx *sql.Tx) error {
+		for id, key := range updates {
+			if _, err := tx.Exec("UPDATE dupe_links SET url = ? WHERE id = ?", key, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Dupe: error updating link keys: %v", err)
+		return
+	}
+
+	log.Printf("Dupe: updated %d link keys to the current rules", len(updates))
+}
@@ -0,0 +1,63 @@
+package dupelink
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		// YouTube
+		{"https://youtu.be/abc-_1", "youtube.com/watch?v=abc-_1"},
+		{"https://youtu.be/abc-_1?t=42", "youtube.com/watch?v=abc-_1"},
+		{"https://youtu.be/abc-_1/", "youtube.com/watch?v=abc-_1"},
+		{"https://www.youtube.com/watch?v=abc-_1&t=42s", "youtube.com/watch?v=abc-_1"},
+		{"https://m.youtube.com/watch?v=abc-_1&feature=share", "youtube.com/watch?v=abc-_1"},
+		{"https://music.youtube.com/watch?v=abc-_1&list=RD1", "youtube.com/watch?v=abc-_1"},
+		{"https://youtube.com/shorts/abc-_1?si=xyz", "youtube.com/watch?v=abc-_1"},
+		{"https://www.youtube.com/shorts/abc-_1/", "youtube.com/watch?v=abc-_1"},
+		{"https://www.youtube.com/playlist?list=PL1&si=x", "youtube.com/playlist?list=PL1"},
+
+		// Tracking parameters, www and the trailing slash
+		{"https://www.example.com/article/?utm_source=tg&utm_medium=social&id=5", "example.com/article?id=5"},
+		{"https://example.com/article/?fbclid=123", "example.com/article"},
+		{"https://EXAMPLE.com/Article", "example.com/Article"},
+
+		// Twitter and X
+		{"https://twitter.com/someone/status/123456?s=20", "x.com/i/status/123456"},
+		{"https://x.com/other/status/123456/photo/1", "x.com/i/status/123456"},
+		{"https://mobile.twitter.com/someone/statuses/123456", "x.com/i/status/123456"},
+		{"https://fxtwitter.com/someone/status/123456", "x.com/i/status/123456"},
+
+		// Reddit
+		{"https://redd.it/abc12", "reddit.com/comments/abc12"},
+		{"https://old.reddit.com/r/golang/comments/abc12/some_title/?utm_source=share", "reddit.com/comments/abc12"},
+		{"https://www.reddit.com/r/golang/comments/abc12/", "reddit.com/comments/abc12"},
+
+		// Spotify
+		{"https://open.spotify.com/intl-de/track/4uLU6hMCjMI75M1A2tKUQC?si=123", "open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC"},
+		{"https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC", "open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC"},
+
+		// Instagram
+		{"https://www.instagram.com/reel/Cxyz_1-2/?igsh=abc", "instagram.com/p/Cxyz_1-2"},
+		{"https://instagram.com/someone/p/Cxyz_1-2/", "instagram.com/p/Cxyz_1-2"},
+
+		// TikTok
+		{"https://www.tiktok.com/@user.name/video/7123456789?is_from_webapp=1", "tiktok.com/video/7123456789"},
+		{"https://m.tiktok.com/v/7123456789.html", "tiktok.com/video/7123456789"},
+	}
+
+	for _, test := range tests {
+		parsedURL, err := url.Parse(test.link)
+		if err != nil {
+			t.Fatalf("parsing %v: %v", test.link, err)
+		}
+
+		if got := canonicalURL(parsedURL); got != test.want {
+			t.Errorf("canonicalURL(%v) = %v, want %v", test.link, got, test.want)
+		}
+	}
+}
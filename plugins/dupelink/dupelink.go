@@ -1,10 +1,16 @@
 package dupelink
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf16"
 
 	"github.com/tucnak/telebot"
 
@@ -15,13 +21,55 @@ import (
 type DupeLinkPlugin struct {
 }
 
+// Forwarded albums already checked, with the time their first item was seen
+var albums = map[string]int64{}
+var albumsMutex sync.Mutex
+
 func init() {
 	registry.RegisterPlugin(&DupeLinkPlugin{})
+	registry.RegisterTool(registry.Tool{
+		Name:        "link_first_posted",
+		Description: "Find out when and by whom a link was first posted in the current chat.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"url": map[string]interface{}{
+					"type":        "string",
+					"description": "The link to look up",
+				},
+			},
+			"required": []string{"url"},
+		},
+		Handler: linkFirstPostedTool,
+	})
 }
 
-func (p *DupeLinkPlugin) Start(interface{}) {}
+func (p *DupeLinkPlugin) Start(interface{}) {
+	recanonicalizeLinks()
+}
 
 func (p *DupeLinkPlugin) Process(message *telebot.Message) {
+	if dupesExp.MatchString(message.Text) {
+		dupesCommand(message)
+		return
+	}
+
+	// The same channel post forwarded again is reported once, not per link
+	if key := forwardKey(message); key != "" {
+		// Items of a forwarded album share the key, only the first one is checked
+		if message.AlbumID != "" && !firstOfAlbum(message.Chat.ID, message.AlbumID, message.Unixtime) {
+			return
+		}
+
+		if reactToURL(key, message) {
+			return
+		}
+	}
+
+	if message.Photo != nil && registry.Config.DupeImages.Enabled && reactToPhoto(message) {
+		return
+	}
+
 	messageURLs := getURLs(message)
 	var validURLs []string
 
@@ -42,13 +90,7 @@ func (p *DupeLinkPlugin) Process(message *telebot.Message) {
 			continue
 		}
 
-		// Custom logic for some of the domains
-		// For example, for open.spotify.com we remove all parameters
-		if parsedURL.Hostname() == "open.spotify.com" {
-			parsedURL.RawQuery = ""
-		}
-
-		currentURL := parsedURL.Hostname() + parsedURL.RequestURI()
+		currentURL := canonicalURL(parsedURL)
 
 		for _, ignoredHostname := range registry.Config.DupeIgnoredDomains {
 			if parsedURL.Hostname() == ignoredHostname {
@@ -64,39 +106,99 @@ func (p *DupeLinkPlugin) Process(message *telebot.Message) {
 	}
 }
 
+// getURLs returns the links of the text and the caption, both plain and hyperlinked
 func getURLs(message *telebot.Message) []string {
+	urls := entityURLs(message.Text, message.Entities)
+	urls = append(urls, entityURLs(message.Caption, message.CaptionEntities)...)
+
+	return urls
+}
+
+func entityURLs(text string, entities []telebot.MessageEntity) []string {
 	var urls []string
 
-	for _, entity := range message.Entities {
-		if entity.Type == "url" {
-			urls = append(urls, string([]rune(message.Text)[entity.Offset:(entity.Offset+entity.Length)]))
+	// Entity offsets count UTF-16 code units
+	encoded := utf16.Encode([]rune(text))
+
+	for _, entity := range entities {
+		var link string
+
+		switch entity.Type {
+		case telebot.EntityURL:
+			if entity.Offset < 0 || entity.Offset+entity.Length > len(encoded) {
+				continue
+			}
+			link = string(utf16.Decode(encoded[entity.Offset:(entity.Offset + entity.Length)]))
+		case telebot.EntityTextLink:
+			link = entity.URL
+		default:
+			continue
+		}
+
+		if !strings.Contains(link, "://") {
+			link = "https://" + link
 		}
+		urls = append(urls, link)
 	}
 
 	return urls
 }
 
-func reactToURL(currentURL string, message *telebot.Message) {
-	bot := registry.Bot
+// forwardKey identifies a post forwarded from a channel. Telebot doesn't expose
+// the original message ID, the channel and the post time stand in for it,
+// so all items of an album get the same key.
+func forwardKey(message *telebot.Message) string {
+	if message.OriginalChat == nil || message.OriginalUnixtime == 0 {
+		return ""
+	}
 
+	return fmt.Sprintf("forward:%d:%d", message.OriginalChat.ID, message.OriginalUnixtime)
+}
+
+// firstOfAlbum reports whether the message is the first one of its album
+// the bot sees, albums older than an hour are forgotten
+func firstOfAlbum(chatID int64, albumID string, unixtime int64) bool {
+	albumsMutex.Lock()
+	defer albumsMutex.Unlock()
+
+	for key, seen := range albums {
+		if unixtime-seen > 3600 {
+			delete(albums, key)
+		}
+	}
+
+	key := strconv.FormatInt(chatID, 10) + ":" + albumID
+	if _, ok := albums[key]; ok {
+		return false
+	}
+
+	albums[key] = unixtime
+	return true
+}
+
+// reactToURL reports the dupe or saves the new link, it returns true for dupes
+func reactToURL(currentURL string, message *telebot.Message) bool {
 	// Try to find existing link
 	var firstName, lastName string
-	var unixtime int64
+	var first original
 
 	err := database.DB.QueryRow(
-		`SELECT u.first_name, u.last_name, d.unixtime 
+		`SELECT u.first_name, u.last_name, d.sender_id, d.unixtime, COALESCE(d.message_id, 0)
 		FROM dupe_links d 
 		JOIN users u ON d.sender_id = u.id 
 		WHERE d.url = ? AND d.chat_id = ? 
 		LIMIT 1`,
-		currentURL, message.Chat.ID).Scan(&firstName, &lastName, &unixtime)
+		currentURL, message.Chat.ID).Scan(&firstName, &lastName, &first.senderID, &first.unixtime, &first.messageID)
 
 	if err == nil {
 		log.Println("Found dupe, reporting: " + currentURL)
-		formattedTime := time.Unix(unixtime, 0).Format(time.RFC1123)
-		formattedUser := firstName + " " + lastName
-		bot.Send(message.Chat, "That was already posted on "+formattedTime+" by "+formattedUser,
-			&telebot.SendOptions{ReplyTo: message})
+		first.author = strings.TrimSpace(firstName + " " + lastName)
+		kind := "link"
+		if strings.HasPrefix(currentURL, "forward:") {
+			kind = "forward"
+		}
+		reportDupe(message, first, kind, currentURL)
+		return true
 	} else {
 		log.Println("Link not found, saving: " + currentURL)
 
@@ -107,7 +209,7 @@ func reactToURL(currentURL string, message *telebot.Message) {
 			message.Sender.ID, message.Sender.Username, message.Sender.FirstName, message.Sender.LastName, string(userData))
 		if err != nil {
 			log.Printf("Error saving user: %v", err)
-			return
+			return false
 		}
 
 		// Then save the dupe link
@@ -118,4 +220,105 @@ func reactToURL(currentURL string, message *telebot.Message) {
 			log.Printf("Error saving dupe link: %v", err)
 		}
 	}
+
+	return false
+}
+
+// original is the first post of a link or photo
+type original struct {
+	author    string
+	senderID  int
+	unixtime  int64
+	messageID int
+}
+
+// reportDupe tells who posted it first and when, linking the original in chats
+// that have message links and replying to it elsewhere. The hit is recorded for !dupes.
+func reportDupe(message *telebot.Message, first original, kind string, key string) {
+	bot := registry.Bot
+
+	posted := time.Unix(first.unixtime, 0).In(registry.Config.TimeLoc)
+	when := relativeTime(posted, time.Now()) + " (" + posted.Format("02.01.2006 15:04") + ")"
+
+	recordHit(message, first, kind, key)
+
+	if link := originalLink(message.Chat, first.messageID); link != "" {
+		bot.Send(message.Chat, "That was already posted "+when+" by "+first.author+"\n"+link,
+			&telebot.SendOptions{ReplyTo: message, DisableWebPagePreview: true})
+		return
+	}
+
+	if first.messageID != 0 {
+		_, err := bot.Send(message.Chat, message.Sender.FirstName+", that was already posted here "+when+" by "+first.author,
+			&telebot.SendOptions{ReplyTo: &telebot.Message{ID: first.messageID, Chat: message.Chat}})
+		if err == nil {
+			return
+		}
+
+		// The original is probably deleted
+		log.Printf("Dupe: error replying to the original: %v", err)
+	}
+
+	bot.Send(message.Chat, "That was already posted "+when+" by "+first.author,
+		&telebot.SendOptions{ReplyTo: message})
+}
+
+// originalLink returns the t.me link to a message, only public chats
+// and supergroups have them
+func originalLink(chat *telebot.Chat, messageID int) string {
+	if messageID == 0 {
+		return ""
+	}
+
+	if chat.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.Username, messageID)
+	}
+
+	if id := strconv.FormatInt(chat.ID, 10); strings.HasPrefix(id, "-100") {
+		return fmt.Sprintf("https://t.me/c/%s/%d", strings.TrimPrefix(id, "-100"), messageID)
+	}
+
+	return ""
+}
+
+func linkFirstPostedTool(chatID int64, arguments string) (string, error) {
+	var args struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", err
+	}
+
+	if !strings.Contains(args.URL, "://") {
+		args.URL = "https://" + args.URL
+	}
+
+	parsedURL, err := url.Parse(args.URL)
+	if err != nil {
+		return "", err
+	}
+
+	currentURL := canonicalURL(parsedURL)
+
+	var firstName, lastName string
+	var unixtime int64
+
+	err = database.DB.QueryRow(
+		`SELECT u.first_name, u.last_name, d.unixtime
+		FROM dupe_links d
+		JOIN users u ON d.sender_id = u.id
+		WHERE d.url = ? AND d.chat_id = ?
+		ORDER BY d.unixtime ASC
+		LIMIT 1`,
+		currentURL, chatID).Scan(&firstName, &lastName, &unixtime)
+	if err == sql.ErrNoRows {
+		return "This link has never been posted in this chat", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	formattedTime := time.Unix(unixtime, 0).In(registry.Config.TimeLoc).Format("02.01.2006 15:04")
+
+	return fmt.Sprintf("First posted on %s by %s", formattedTime, strings.TrimSpace(firstName+" "+lastName)), nil
 }
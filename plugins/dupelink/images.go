@@ -0,0 +1,99 @@
+package dupelink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/imagehash"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+const (
+	defaultImageThreshold  = 6
+	defaultImageCandidates = 20000
+)
+
+// reactToPhoto reports the photo if a similar one was posted in the chat before,
+// otherwise remembers its hash. It returns true for dupes.
+func reactToPhoto(message *telebot.Message) bool {
+	data, err := registry.Bot.DownloadFile(message.Photo.FileID)
+	if err != nil {
+		log.Printf("Dupe: error downloading photo: %v", err)
+		return false
+	}
+
+	hash, err := imagehash.DHashBytes(data)
+	if errors.Is(err, imagehash.ErrFlat) {
+		// Blank and gradient images would match each other
+		log.Printf("Dupe: skipping flat photo in chat %v", message.Chat.ID)
+		return false
+	}
+	if err != nil {
+		log.Printf("Dupe: error hashing photo: %v", err)
+		return false
+	}
+
+	threshold := defaultImageThreshold
+	if registry.Config.DupeImages.Threshold != nil {
+		threshold = *registry.Config.DupeImages.Threshold
+	}
+
+	candidates := defaultImageCandidates
+	if registry.Config.DupeImages.MaxCandidates > 0 {
+		candidates = registry.Config.DupeImages.MaxCandidates
+	}
+
+	// Newest first so the window is the latest photos, ties go to the older one below
+	rows, err := database.DB.Query(
+		`SELECT h.hash, h.sender_id, h.unixtime, h.message_id, COALESCE(u.first_name, ''), COALESCE(u.last_name, '')
+		FROM image_hashes h
+		LEFT JOIN users u ON h.sender_id = u.id
+		WHERE h.chat_id = ?
+		ORDER BY h.unixtime DESC, h.id DESC
+		LIMIT ?`,
+		message.Chat.ID, candidates)
+	if err != nil {
+		log.Printf("Dupe: error loading image hashes: %v", err)
+		return false
+	}
+
+	best := threshold + 1
+	var first original
+	for rows.Next() {
+		var stored int64
+		var candidate original
+		var firstName, lastName string
+		err := rows.Scan(&stored, &candidate.senderID, &candidate.unixtime, &candidate.messageID, &firstName, &lastName)
+		if err != nil {
+			log.Printf("Dupe: error scanning image hash: %v", err)
+			continue
+		}
+
+		if distance := imagehash.Distance(hash, uint64(stored)); distance <= best && distance <= threshold {
+			best = distance
+			candidate.author = strings.TrimSpace(firstName + " " + lastName)
+			first = candidate
+		}
+	}
+	rows.Close()
+
+	if best <= threshold {
+		log.Printf("Found dupe photo in chat %v, distance %d", message.Chat.ID, best)
+		reportDupe(message, first, "photo", fmt.Sprintf("photo:%d", first.messageID))
+		return true
+	}
+
+	_, err = database.DB.Exec(
+		"INSERT INTO image_hashes (chat_id, message_id, sender_id, hash, unixtime) VALUES (?, ?, ?, ?, ?)",
+		message.Chat.ID, message.ID, message.Sender.ID, int64(hash), message.Unixtime)
+	if err != nil {
+		log.Printf("Dupe: error saving image hash: %v", err)
+	}
+
+	return false
+}
@@ -0,0 +1,120 @@
+package dupelink
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+var dupesExp = regexp.MustCompile(`(?i)^\!(dupes|дубли)$`)
+
+const leaderboardSize = 5
+
+// recordHit saves the repost for the !dupes leaderboards
+func recordHit(message *telebot.Message, first original, kind string, key string) {
+	_, err := database.DB.Exec(
+		`INSERT INTO dupe_hits (chat_id, kind, key, sender_id, original_sender_id, message_id, unixtime)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		message.Chat.ID, kind, key, message.Sender.ID, first.senderID, message.ID, message.Unixtime)
+	if err != nil {
+		log.Printf("Dupe: error saving dupe hit: %v", err)
+	}
+}
+
+// relativeTime describes how long ago the moment was
+func relativeTime(then time.Time, now time.Time) string {
+	elapsed := now.Sub(then)
+
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return plural(int(elapsed/time.Minute), "minute") + " ago"
+	case elapsed < 24*time.Hour:
+		return plural(int(elapsed/time.Hour), "hour") + " ago"
+	case elapsed < 48*time.Hour:
+		return "yesterday"
+	case elapsed < 30*24*time.Hour:
+		return plural(int(elapsed/(24*time.Hour)), "day") + " ago"
+	case elapsed < 365*24*time.Hour:
+		return plural(int(elapsed/(30*24*time.Hour)), "month") + " ago"
+	}
+
+	return plural(int(elapsed/(365*24*time.Hour)), "year") + " ago"
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// dupesCommand shows who reposts the most, whose posts get reposted
+// and which links come back again and again
+func dupesCommand(message *telebot.Message) {
+	chatID := message.Chat.ID
+
+	reposters := leaderboard(
+		`SELECT TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), COUNT(*) AS hits
+		FROM dupe_hits h LEFT JOIN users u ON u.id = h.sender_id
+		WHERE h.chat_id = ?
+		GROUP BY h.sender_id ORDER BY hits DESC LIMIT ?`, chatID)
+	originals := leaderboard(
+		`SELECT TRIM(COALESCE(u.first_name, '') || ' ' || COALESCE(u.last_name, '')), COUNT(*) AS hits
+		FROM dupe_hits h LEFT JOIN users u ON u.id = h.original_sender_id
+		WHERE h.chat_id = ?
+		GROUP BY h.original_sender_id ORDER BY hits DESC LIMIT ?`, chatID)
+	links := leaderboard(
+		`SELECT key, COUNT(*) AS hits
+		FROM dupe_hits
+		WHERE chat_id = ? AND kind = 'link'
+		GROUP BY key ORDER BY hits DESC LIMIT ?`, chatID)
+
+	if len(reposters) == 0 {
+		registry.Bot.Send(message.Chat, "No dupes yet, well done", &telebot.SendOptions{})
+		return
+	}
+
+	text := "Most duped members:\n" + strings.Join(reposters, "\n") +
+		"\n\nMost reposted authors:\n" + strings.Join(originals, "\n")
+	if len(links) > 0 {
+		text += "\n\nMost reposted links:\n" + strings.Join(links, "\n")
+	}
+
+	registry.Bot.Send(message.Chat, text, &telebot.SendOptions{DisableWebPagePreview: true})
+}
+
+// leaderboard runs a query returning a name and a count and formats the rows
+func leaderboard(query string, chatID int64) []string {
+	rows, err := database.DB.Query(query, chatID, leaderboardSize)
+	if err != nil {
+		log.Printf("Dupe: error loading leaderboard: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var name string
+		var hits int
+		if err := rows.Scan(&name, &hits); err != nil {
+			log.Printf("Dupe: error scanning leaderboard: %v", err)
+			continue
+		}
+		if name == "" {
+			name = "Someone"
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s — %s", len(lines)+1, name, plural(hits, "dupe")))
+	}
+
+	return lines
+}
@@ -0,0 +1,306 @@
+package markov
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type MarkovPlugin struct {
+}
+
+const (
+	startToken = "\x02"
+	endToken   = "\x03"
+	batchSize  = 1000
+)
+
+var rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+var rngMutex sync.Mutex
+
+var markovExp = regexp.MustCompile(`(?i)^\!(markov|марков)(\s+@?(\w+))?$`)
+
+func init() {
+	registry.RegisterPlugin(&MarkovPlugin{})
+	registry.RegisterGenerator("markov", generate)
+}
+
+func (p *MarkovPlugin) Start(interface{}) {
+	config := &registry.Config.Markov
+
+	if config.MaxWords <= 0 {
+		config.MaxWords = 30
+	}
+	if config.TrainInterval <= 0 {
+		config.TrainInterval = time.Minute
+	}
+
+	go func() {
+		for {
+			train()
+			time.Sleep(config.TrainInterval)
+		}
+	}()
+}
+
+func (p *MarkovPlugin) Process(message *telebot.Message) {
+	match := markovExp.FindStringSubmatch(message.Text)
+	if match == nil {
+		return
+	}
+
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	userID := 0
+	if match[3] != "" {
+		err := database.DB.QueryRow("SELECT id FROM users WHERE username = ? COLLATE NOCASE", match[3]).Scan(&userID)
+		if err != nil {
+			bot.Send(message.Chat, "Не знаю такого", options)
+			return
+		}
+	}
+
+	text := generate(message.Chat.ID, userID)
+	if text == "" {
+		bot.Send(message.Chat, "Мне пока нечего сказать", options)
+		return
+	}
+
+	bot.Send(message.Chat, text, options)
+}
+
+// source is a table the chains learn from. Rows are read in (unixtime,
+// chat_id, id) order: the rowid changes whenever logwrite replaces a message.
+type source struct {
+	name  string
+	query string
+}
+
+var sources = []source{
+	// Voice messages are left to their transcripts
+	{"messages", `SELECT m.unixtime, m.chat_id, m.id, m.sender_id, COALESCE(m.text, '') FROM messages m
+		WHERE (m.unixtime, m.chat_id, m.id) > (?, ?, ?)
+		AND NOT EXISTS (SELECT 1 FROM transcripts t WHERE t.message_id = m.id AND t.chat_id = m.chat_id)
+		ORDER BY m.unixtime, m.chat_id, m.id LIMIT ?`},
+
+	// Transcripts are written after the message, so they get their own progress
+	{"transcripts", `SELECT t.unixtime, t.chat_id, t.message_id, m.sender_id, COALESCE(t.text, '') FROM transcripts t
+		JOIN messages m ON m.id = t.message_id AND m.chat_id = t.chat_id
+		WHERE (t.unixtime, t.chat_id, t.message_id) > (?, ?, ?)
+		ORDER BY t.unixtime, t.chat_id, t.message_id LIMIT ?`},
+}
+
+// progress is the key of the last row a source was trained on
+type progress struct {
+	unixtime  int64
+	chatID    int64
+	messageID int
+}
+
+// train adds the messages saved since the last run to the chains
+func train() {
+	for _, src := range sources {
+		for {
+			trained, err := trainBatch(src)
+			if err != nil {
+				log.Printf("Markov: error training on %v: %v", src.name, err)
+				break
+			}
+
+			if trained > 0 {
+				log.Printf("Markov: trained on %v %v", trained, src.name)
+			}
+			if trained < batchSize {
+				break
+			}
+		}
+	}
+}
+
+// trainBatch learns from the next batch of rows in a single transaction
+// together with moving the progress marker, returns the number of rows read
+func trainBatch(src source) (int, error) {
+	var botID int
+	if registry.Bot != nil {
+		botID = registry.Bot.Me.ID
+	}
+
+	count := 0
+	err := database.WithTx(context.Background(), func(tx *sql.Tx) error {
+		var last progress
+		err := tx.QueryRow(
+			"SELECT unixtime, chat_id, message_id FROM markov_progress WHERE source = ?",
+			src.name).Scan(&last.unixtime, &last.chatID, &last.messageID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		rows, err := tx.Query(src.query, last.unixtime, last.chatID, last.messageID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		type row struct {
+			chatID int64
+			userID int
+			text   string
+		}
+
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&last.unixtime, &last.chatID, &last.messageID, &r.userID, &r.text); err != nil {
+				rows.Close()
+				return err
+			}
+			r.chatID = last.chatID
+			batch = append(batch, r)
+		}
+		rows.Close()
+
+		count = len(batch)
+
+		for _, r := range batch {
+			if r.userID == botID || strings.HasPrefix(r.text, "!") || strings.HasPrefix(r.text, "/") {
+				continue
+			}
+
+			words := tokenize(r.text)
+			if len(words) == 0 {
+				continue
+			}
+
+			chain := append([]string{startToken, startToken}, words...)
+			chain = append(chain, endToken)
+
+			for i := 2; i < len(chain); i++ {
+				_, err := tx.Exec(
+					`INSERT INTO markov_ngrams (chat_id, user_id, prefix, next, count) VALUES (?, ?, ?, ?, 1)
+					ON CONFLICT(chat_id, user_id, prefix, next) DO UPDATE SET count = count + 1`,
+					r.chatID, r.userID, chain[i-2]+" "+chain[i-1], chain[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if count == 0 {
+			return nil
+		}
+
+		_, err = tx.Exec(
+			"INSERT OR REPLACE INTO markov_progress (source, unixtime, chat_id, message_id) VALUES (?, ?, ?, ?)",
+			src.name, last.unixtime, last.chatID, last.messageID)
+		return err
+	})
+
+	return count, err
+}
+
+// tokenize splits the text into words, dropping links and mentions
+func tokenize(text string) []string {
+	var words []string
+
+	for _, word := range strings.Fields(text) {
+		if strings.Contains(word, "://") || strings.HasPrefix(word, "@") {
+			continue
+		}
+		words = append(words, word)
+	}
+
+	return words
+}
+
+// generate walks the chain of the chat, or of a single member when userID is set
+func generate(chatID int64, userID int) string {
+	// Short sentences are retried a few times for something more fun
+	var best []string
+	for attempt := 0; attempt < 5; attempt++ {
+		words := walk(chatID, userID)
+		if len(words) > len(best) {
+			best = words
+		}
+		if len(best) >= 4 {
+			break
+		}
+	}
+
+	return strings.Join(best, " ")
+}
+
+func walk(chatID int64, userID int) []string {
+	var words []string
+	first, second := startToken, startToken
+
+	for len(words) < registry.Config.Markov.MaxWords {
+		next := pickNext(chatID, userID, first+" "+second)
+		if next == "" || next == endToken {
+			break
+		}
+
+		words = append(words, next)
+		first, second = second, next
+	}
+
+	return words
+}
+
+// pickNext chooses the next word weighted by how often it followed the prefix
+func pickNext(chatID int64, userID int, prefix string) string {
+	query := "SELECT next, SUM(count) FROM markov_ngrams WHERE chat_id = ? AND prefix = ? GROUP BY next"
+	args := []interface{}{chatID, prefix}
+	if userID != 0 {
+		query = "SELECT next, count FROM markov_ngrams WHERE chat_id = ? AND prefix = ? AND user_id = ?"
+		args = append(args, userID)
+	}
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Markov: error loading chain: %v", err)
+		return ""
+	}
+	defer rows.Close()
+
+	var candidates []string
+	var weights []int
+	total := 0
+	for rows.Next() {
+		var next string
+		var count int
+		if err := rows.Scan(&next, &count); err != nil {
+			log.Printf("Markov: error scanning chain: %v", err)
+			return ""
+		}
+		candidates = append(candidates, next)
+		weights = append(weights, count)
+		total += count
+	}
+
+	if total == 0 {
+		return ""
+	}
+
+	rngMutex.Lock()
+	roll := rng.Intn(total)
+	rngMutex.Unlock()
+
+	for i, weight := range weights {
+		if roll < weight {
+			return candidates[i]
+		}
+		roll -= weight
+	}
+
+	return ""
+}
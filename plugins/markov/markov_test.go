@@ -0,0 +1,113 @@
+package markov
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// TestMain creates the bot database in a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "muxgoob")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "db"), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	database.Initialize()
+	registry.Config.Markov.MaxWords = 30
+
+	code := m.Run()
+
+	database.DB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"  привет,   мир! ", []string{"привет,", "мир!"}},
+		{"look https://example.com/x here", []string{"look", "here"}},
+		{"@someone hi @other", []string{"hi"}},
+		{"line\nbreak\ttab", []string{"line", "break", "tab"}},
+	}
+
+	for _, test := range tests {
+		if got := tokenize(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTrainAndGenerate(t *testing.T) {
+	const chatID = int64(-1001)
+
+	saveMessage := func(id int, userID int, unixtime int64, text string) {
+		t.Helper()
+		// logwrite replaces the row, which gives it a new rowid
+		_, err := database.DB.Exec(
+			"INSERT OR REPLACE INTO messages (id, chat_id, sender_id, unixtime, text) VALUES (?, ?, ?, ?, ?)",
+			id, chatID, userID, unixtime, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saveMessage(1, 10, 1700000000, "hello big world")
+	saveMessage(2, 20, 1700000001, "!markov")
+	saveMessage(3, 30, 1700000002, "")
+	train()
+
+	if got := generate(chatID, 0); got != "hello big world" {
+		t.Errorf("got %q, want the only message", got)
+	}
+
+	// Replacing a trained message must not teach it twice
+	saveMessage(1, 10, 1700000000, "hello big world")
+	train()
+
+	var count int
+	err := database.DB.QueryRow(
+		"SELECT SUM(count) FROM markov_ngrams WHERE chat_id = ? AND user_id = 10 AND next = 'hello'",
+		chatID).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got count %d after replacing the message, want 1", count)
+	}
+
+	// The voice message is learned once its transcript is written
+	_, err = database.DB.Exec(
+		"INSERT INTO transcripts (message_id, chat_id, model, text, unixtime) VALUES (3, ?, 'whisper', 'spoken words here', 1700000100)",
+		chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.DB.Exec("UPDATE messages SET text = 'spoken words here' WHERE id = 3 AND chat_id = ?", chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	train()
+
+	if got := generate(chatID, 30); got != "spoken words here" {
+		t.Errorf("got %q for the voice message author, want the transcript", got)
+	}
+	if got := generate(chatID, 20); got != "" {
+		t.Errorf("got %q for the command author, want nothing", got)
+	}
+}
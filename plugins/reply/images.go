@@ -0,0 +1,89 @@
+package reply
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// messageText returns the text of the message or the caption of its media
+func messageText(message *telebot.Message) string {
+	if message.Text != "" {
+		return message.Text
+	}
+
+	return message.Caption
+}
+
+// attachedPhoto returns the photo of the message or of the message it replies to
+func attachedPhoto(message *telebot.Message) (*telebot.Photo, string) {
+	if message.Photo != nil {
+		return message.Photo, ""
+	}
+
+	if message.ReplyTo != nil && message.ReplyTo.Photo != nil {
+		return message.ReplyTo.Photo, message.ReplyTo.Caption
+	}
+
+	return nil, ""
+}
+
+// buildUserMessage attaches the photo to the prompt for vision-capable models
+// and describes it in words for the rest
+func buildUserMessage(message *telebot.Message, userMessage string, model string) openai.ChatCompletionMessage {
+	photo, caption := attachedPhoto(message)
+
+	if photo == nil {
+		return openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: userMessage,
+		}
+	}
+
+	if caption != "" {
+		userMessage += "\n\nПодпись к изображению: " + caption
+	}
+
+	if !ai.SupportsVision(model) {
+		return openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: userMessage + "\n\n[К сообщению приложено изображение, но ты не можешь его увидеть]",
+		}
+	}
+
+	image, err := registry.Bot.DownloadFile(photo.FileID)
+	if err != nil {
+		log.Printf("ChatGPT request: error downloading photo: %v", err)
+		return openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: userMessage + "\n\n[К сообщению приложено изображение, но его не удалось загрузить]",
+		}
+	}
+
+	log.Printf("ChatGPT request: attaching photo of %v bytes", len(image))
+
+	dataURL := "data:" + http.DetectContentType(image) + ";base64," + base64.StdEncoding.EncodeToString(image)
+
+	return openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{
+				Type: openai.ChatMessagePartTypeText,
+				Text: userMessage,
+			},
+			{
+				Type: openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{
+					URL:    dataURL,
+					Detail: openai.ImageURLDetailAuto,
+				},
+			},
+		},
+	}
+}
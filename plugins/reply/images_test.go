@@ -0,0 +1,116 @@
+package reply
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// visionStub plays both the Telegram servers and the AI provider,
+// it keeps the chat completion requests it receives
+func visionStub(t *testing.T, requests *[]openai.ChatCompletionRequest) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/botTOKEN/getFile":
+			w.Write([]byte(`{"ok": true, "result": {"file_id": "photo", "file_path": "photos/file_1.png"}}`))
+		case "/file/botTOKEN/photos/file_1.png":
+			w.Write(testPNG)
+		case "/chat/completions":
+			var request openai.ChatCompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Errorf("decoding request: %v", err)
+			}
+			*requests = append(*requests, request)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"choices": [{"index": 0, "message": {"role": "assistant", "content": "Это котик"}}],
+				"usage": {"prompt_tokens": 10, "completion_tokens": 2}}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+
+	target, _ := url.Parse(server.URL)
+	transport := http.DefaultTransport
+	http.DefaultTransport = roundTripper(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "api.telegram.org" {
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+		}
+		return transport.RoundTrip(r)
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		server.Close()
+	})
+
+	return server
+}
+
+func TestAskChatGptWithPhoto(t *testing.T) {
+	var requests []openai.ChatCompletionRequest
+	server := visionStub(t, &requests)
+
+	registry.Bot = &registry.BotWrapper{Bot: &telebot.Bot{Token: "TOKEN"}}
+	registry.Config.TelegramFileURL = server.URL + "/file/bot"
+	registry.Config.AiBaseURL = server.URL
+	registry.Config.SemanticMemory.Enabled = false
+	defer func() {
+		registry.Config.TelegramFileURL = ""
+		registry.Config.AiBaseURL = ""
+		registry.Config.AiVisionModels = nil
+	}()
+
+	message := &telebot.Message{
+		ID:      1,
+		Chat:    &telebot.Chat{ID: -1002},
+		Sender:  &telebot.User{ID: 42, FirstName: "Вася"},
+		Photo:   &telebot.Photo{File: telebot.File{FileID: "photo"}},
+		Caption: "губи, что на фото?",
+	}
+
+	// A vision model gets the photo as a data URL
+	registry.Config.AiVisionModels = []string{"gpt-4o-mini"}
+	if reply, err := askChatGpt(message, true); err != nil || reply != "Это котик" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+
+	user := requests[0].Messages[1]
+	if len(user.MultiContent) != 2 || user.MultiContent[0].Text != "губи, что на фото?" {
+		t.Fatalf("got user message %+v, want the question and the photo", user)
+	}
+	wantURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG)
+	if image := user.MultiContent[1].ImageURL; image == nil || image.URL != wantURL {
+		t.Errorf("got image %+v, want %v", image, wantURL)
+	}
+
+	// The rest are told there is a photo they can't see
+	registry.Config.AiVisionModels = nil
+	message.ID = 2
+	if _, err := askChatGpt(message, true); err != nil {
+		t.Fatal(err)
+	}
+
+	user = requests[1].Messages[1]
+	if len(user.MultiContent) != 0 || !strings.Contains(user.Content, "не можешь его увидеть") {
+		t.Errorf("got user message %+v, want a text note about the photo", user)
+	}
+}
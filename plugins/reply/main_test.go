@@ -0,0 +1,36 @@
+package reply
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// TestMain creates the bot database in a temporary directory,
+// tests share it so each of them uses its own chat ID
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "muxgoob")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "db"), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	database.Initialize()
+	registry.Config.TimeLoc = time.UTC
+
+	code := m.Run()
+
+	database.DB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
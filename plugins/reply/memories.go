@@ -0,0 +1,268 @@
+package reply
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type memory struct {
+	id       int
+	text     string
+	unixtime int64
+}
+
+var rememberExp *regexp.Regexp
+var memoriesExp = regexp.MustCompile(`(?i)^\!(память|memories)$`)
+var forgetExp = regexp.MustCompile(`(?i)^\!(забудь|forget)\s+(\d+|все|all)$`)
+
+func startUserMemory() {
+	config := &registry.Config.UserMemory
+
+	if !config.Enabled {
+		return
+	}
+
+	if config.Pattern == "" {
+		config.Pattern = `(?is)^(gooby|губи|губ(я)+н),?\s*запомни[,:]?\s+(?P<fact>.+)$`
+	}
+	if config.MaxPerUser <= 0 {
+		config.MaxPerUser = 50
+	}
+	if config.MaxLength <= 0 {
+		config.MaxLength = 500
+	}
+	if config.MaxInjected <= 0 {
+		config.MaxInjected = 5
+	}
+
+	exp, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		log.Printf("Reply: bad user memory pattern: %v", err)
+		return
+	}
+	rememberExp = exp
+}
+
+// handleMemoryCommands saves, lists and deletes memories, returns false for other messages
+func handleMemoryCommands(message *telebot.Message) bool {
+	if rememberExp == nil {
+		return false
+	}
+
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	if match := rememberExp.FindStringSubmatch(message.Text); match != nil {
+		fact := match[len(match)-1]
+		if i := rememberExp.SubexpIndex("fact"); i > 0 {
+			fact = match[i]
+		}
+
+		bot.Send(message.Chat, remember(message, strings.TrimSpace(fact)), options)
+		return true
+	}
+
+	if memoriesExp.MatchString(message.Text) {
+		memories := loadMemories(message.Sender.ID, message.Chat.ID)
+		if len(memories) == 0 {
+			bot.Send(message.Chat, "Я ничего о тебе не помню", options)
+			return true
+		}
+
+		var list string
+		for _, m := range memories {
+			date := time.Unix(m.unixtime, 0).In(registry.Config.TimeLoc).Format("02.01.2006")
+			list += fmt.Sprintf("%d. %s (%s)\n", m.id, m.text, date)
+		}
+
+		bot.Send(message.Chat, "Что я о тебе помню:\n"+list+"\nУдалить: !забудь <номер|все>", options)
+		return true
+	}
+
+	if match := forgetExp.FindStringSubmatch(message.Text); match != nil {
+		var result sql.Result
+		var err error
+		if id, convErr := strconv.Atoi(match[2]); convErr == nil {
+			result, err = database.DB.Exec(
+				"DELETE FROM user_memories WHERE id = ? AND user_id = ? AND chat_id = ?",
+				id, message.Sender.ID, message.Chat.ID)
+		} else {
+			result, err = database.DB.Exec(
+				"DELETE FROM user_memories WHERE user_id = ? AND chat_id = ?",
+				message.Sender.ID, message.Chat.ID)
+		}
+
+		if err != nil {
+			log.Printf("Reply: error deleting memories: %v", err)
+			return true
+		}
+
+		if removed, _ := result.RowsAffected(); removed == 0 {
+			bot.Send(message.Chat, "Нечего забывать, такого я не помню", options)
+			return true
+		}
+
+		bot.Send(message.Chat, "Забыл 🫡", options)
+		return true
+	}
+
+	return false
+}
+
+func remember(message *telebot.Message, fact string) string {
+	config := registry.Config.UserMemory
+
+	if fact == "" {
+		return "Что запомнить?"
+	}
+	if len([]rune(fact)) > config.MaxLength {
+		return "Слишком длинно, не запомню"
+	}
+
+	var count int
+	err := database.DB.QueryRow(
+		"SELECT COUNT(*) FROM user_memories WHERE user_id = ? AND chat_id = ?",
+		message.Sender.ID, message.Chat.ID).Scan(&count)
+	if err != nil {
+		log.Printf("Reply: error counting memories: %v", err)
+		return "Не получилось запомнить"
+	}
+	if count >= config.MaxPerUser {
+		return "Я и так слишком много о тебе помню, удали что-нибудь через !забудь"
+	}
+
+	_, err = database.DB.Exec(
+		"INSERT INTO user_memories (user_id, chat_id, text, unixtime) VALUES (?, ?, ?, ?)",
+		message.Sender.ID, message.Chat.ID, fact, time.Now().Unix())
+	if err != nil {
+		log.Printf("Reply: error saving memory: %v", err)
+		return "Не получилось запомнить"
+	}
+
+	log.Printf("Reply: remembered a fact about user %v", message.Sender.ID)
+
+	return "Запомнил 👌"
+}
+
+// loadMemories returns the memories of the user in the chat, newest first
+func loadMemories(userID int, chatID int64) []memory {
+	rows, err := database.DB.Query(
+		"SELECT id, text, unixtime FROM user_memories WHERE user_id = ? AND chat_id = ? ORDER BY unixtime DESC, id DESC",
+		userID, chatID)
+	if err != nil {
+		log.Printf("Reply: error loading memories: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var memories []memory
+	for rows.Next() {
+		var m memory
+		if err := rows.Scan(&m.id, &m.text, &m.unixtime); err != nil {
+			log.Printf("Reply: error scanning memory: %v", err)
+			continue
+		}
+		memories = append(memories, m)
+	}
+
+	return memories
+}
+
+// relevantMemories picks the memories sharing the most words with the question,
+// all of them are used when there are only a few
+func relevantMemories(userID int, chatID int64, question string) []memory {
+	limit := registry.Config.UserMemory.MaxInjected
+
+	memories := loadMemories(userID, chatID)
+	if len(memories) <= limit {
+		return memories
+	}
+
+	questionWords := keywords(question)
+
+	scores := map[int]int{}
+	var relevant []memory
+	for _, m := range memories {
+		for _, word := range keywords(m.text) {
+			for _, questionWord := range questionWords {
+				if sameStem(word, questionWord) {
+					scores[m.id]++
+					break
+				}
+			}
+		}
+		if scores[m.id] > 0 {
+			relevant = append(relevant, m)
+		}
+	}
+
+	// Stable sort keeps newer memories first among equal scores
+	sort.SliceStable(relevant, func(i, j int) bool {
+		return scores[relevant[i].id] > scores[relevant[j].id]
+	})
+
+	if len(relevant) > limit {
+		relevant = relevant[:limit]
+	}
+
+	return relevant
+}
+
+// keywords splits the text into lowercase words, skipping the short ones
+func keywords(text string) [][]rune {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var result [][]rune
+	for _, word := range words {
+		if runes := []rune(word); len(runes) >= 4 {
+			result = append(result, runes)
+		}
+	}
+
+	return result
+}
+
+// sameStem compares words ignoring up to two letters of ending,
+// so that "Берлин" matches "Берлине" and "кота" matches "котов"
+func sameStem(a []rune, b []rune) bool {
+	shorter := len(a)
+	if len(b) < shorter {
+		shorter = len(b)
+	}
+
+	need := shorter - 2
+	if need < 3 {
+		need = 3
+	}
+
+	common := 0
+	for common < shorter && a[common] == b[common] {
+		common++
+	}
+
+	return common >= need
+}
+
+func formatMemories(memories []memory) string {
+	var result string
+
+	for _, m := range memories {
+		result += "- " + m.text + "\n"
+	}
+
+	return result
+}
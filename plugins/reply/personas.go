@@ -0,0 +1,205 @@
+package reply
+
+import (
+	"database/sql"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// persona is a configured persona with the chat_gpt_* defaults filled in,
+// an empty name stands for the default settings
+type persona struct {
+	registry.PersonaConfig
+	name string
+}
+
+// promptData is available to the prompt templates
+type promptData struct {
+	ChatTitle  string
+	SenderName string
+	Date       string
+	Language   string
+	Question   string
+}
+
+var personaExp = regexp.MustCompile(`(?i)^\!(persona|персона)(\s+(\S+))?$`)
+
+// chatPersona returns the persona picked by the chat admins or assigned in the config
+func chatPersona(chatID int64) persona {
+	var name string
+	err := database.DB.QueryRow("SELECT persona FROM chat_personas WHERE chat_id = ?", chatID).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Reply: error loading persona of chat %v: %v", chatID, err)
+	}
+
+	if name == "" {
+		for _, chatConfig := range registry.Config.ChatGptConfigPerChat {
+			if chatConfig.ChatID == chatID {
+				name = chatConfig.Persona
+				break
+			}
+		}
+	}
+
+	p := persona{}
+	if config, ok := registry.Config.Personas[name]; ok {
+		p = persona{PersonaConfig: config, name: name}
+	} else if name != "" {
+		log.Printf("Reply: unknown persona %v in chat %v, using defaults", name, chatID)
+	}
+
+	if p.SystemPrompt == "" {
+		p.SystemPrompt = registry.Config.ChatGptSystemPrompt
+	}
+	if p.UserPrompt == "" {
+		p.UserPrompt = registry.Config.ChatGptUserPrompt
+	}
+	if p.Temperature == nil {
+		temperature := float32(0.7)
+		p.Temperature = &temperature
+	}
+	if p.HistoryDepth <= 0 {
+		p.HistoryDepth = registry.Config.ChatGptHistoryDepth
+	}
+
+	return p
+}
+
+func newPromptData(message *telebot.Message, language string, question string) promptData {
+	chatTitle := message.Chat.Title
+	if chatTitle == "" {
+		chatTitle = "личная переписка"
+	}
+
+	return promptData{
+		ChatTitle:  chatTitle,
+		SenderName: senderName(message.Sender),
+		Date:       time.Now().In(registry.Config.TimeLoc).Format("02.01.2006"),
+		Language:   language,
+		Question:   question,
+	}
+}
+
+func senderName(user *telebot.User) string {
+	if user.Username != "" {
+		return user.Username
+	}
+
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// renderPrompt executes the prompt template, old fmt-style prompts
+// with a single %s are treated as {{.Question}}
+func renderPrompt(prompt string, data promptData) string {
+	if isFmtPrompt(prompt) {
+		prompt = strings.Replace(prompt, "%s", "{{.Question}}", 1)
+	}
+
+	tmpl, err := template.New("prompt").Parse(prompt)
+	if err != nil {
+		log.Printf("Reply: error parsing prompt template: %v", err)
+		return prompt
+	}
+
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		log.Printf("Reply: error rendering prompt template: %v", err)
+		return prompt
+	}
+
+	return result.String()
+}
+
+// renderUserPrompt renders the user prompt and appends the question
+// when the template doesn't use it, so the question is never lost
+func renderUserPrompt(prompt string, data promptData) string {
+	rendered := renderPrompt(prompt, data)
+
+	if !isFmtPrompt(prompt) && !strings.Contains(prompt, ".Question") {
+		if rendered == "" {
+			return data.Question
+		}
+		rendered += "\n\n" + data.Question
+	}
+
+	return rendered
+}
+
+func isFmtPrompt(prompt string) bool {
+	return !strings.Contains(prompt, "{{") && strings.Contains(prompt, "%s")
+}
+
+// handlePersonaCommand shows the personas or lets admins switch the chat to another one
+func handlePersonaCommand(message *telebot.Message, name string) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	if name == "" {
+		current := chatPersona(message.Chat.ID).name
+		if current == "" {
+			current = "default"
+		}
+
+		names := []string{"default"}
+		for personaName := range registry.Config.Personas {
+			names = append(names, personaName)
+		}
+		sort.Strings(names[1:])
+
+		var list string
+		for _, personaName := range names {
+			line := "• " + personaName
+			if description := registry.Config.Personas[personaName].Description; description != "" {
+				line += " — " + description
+			}
+			if personaName == current {
+				line += " ✅"
+			}
+			list += line + "\n"
+		}
+
+		bot.Send(message.Chat, "Персоны:\n"+list+"\nСменить: !persona <имя>", options)
+		return
+	}
+
+	if !bot.IsAdmin(message.Chat, message.Sender) {
+		bot.Send(message.Chat, "Менять персону могут только админы чата", options)
+		return
+	}
+
+	if name == "default" {
+		_, err := database.DB.Exec("DELETE FROM chat_personas WHERE chat_id = ?", message.Chat.ID)
+		if err != nil {
+			log.Printf("Reply: error resetting persona: %v", err)
+			return
+		}
+
+		bot.Send(message.Chat, "Персона сброшена", options)
+		return
+	}
+
+	if _, ok := registry.Config.Personas[name]; !ok {
+		bot.Send(message.Chat, "Нет такой персоны: "+name, options)
+		return
+	}
+
+	_, err := database.DB.Exec(
+		"INSERT OR REPLACE INTO chat_personas (chat_id, persona, set_by, unixtime) VALUES (?, ?, ?, ?)",
+		message.Chat.ID, name, message.Sender.ID, time.Now().Unix())
+	if err != nil {
+		log.Printf("Reply: error saving persona: %v", err)
+		return
+	}
+
+	log.Printf("Reply: chat %v switched to persona %v", message.Chat.ID, name)
+	bot.Send(message.Chat, "Персона: "+name, options)
+}
@@ -4,17 +4,22 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"regexp"
 	"sort"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sashabaranov/go-openai"
 	"github.com/tucnak/telebot"
 
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/moderation"
 	"github.com/focusshifter/muxgoob/registry"
 )
 
@@ -22,6 +27,8 @@ type ReplyPlugin struct {
 }
 
 var sqliteDb *sql.DB
+
+var errBlocked = errors.New("blocked by moderation")
 var rng *rand.Rand
 
 func init() {
@@ -35,86 +42,51 @@ func (p *ReplyPlugin) Start(_ interface{}) {
 		log.Fatal("Failed to open SQLite DB:", err)
 	}
 	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	loadRules()
+	startSemanticMemory()
+	startUserMemory()
 }
 
 func (p *ReplyPlugin) Process(message *telebot.Message) {
 	bot := registry.Bot
-	rngInt := rng.Int()
+
+	if handleMemoryCommands(message) {
+		return
+	}
 
 	// Check if this is a reply to bot's message
 	if message.ReplyTo != nil && message.ReplyTo.Sender.Username == bot.Me.Username {
-		replyText := askChatGpt(message)
+		replyText, err := askChatGpt(message, true)
+		if errors.Is(err, ai.ErrBudgetExceeded) || errors.Is(err, ai.ErrRateLimited) {
+			replyText = ai.Refusal()
+		}
 		if replyText != "" {
-			bot.Send(message.Chat, replyText, &telebot.SendOptions{ReplyTo: message})
+			bot.SendFormatted(message.Chat, replyText, &telebot.SendOptions{ReplyTo: message})
 		}
 		return
 	}
 
 	techExp := regexp.MustCompile(`(?i)^\!ттх$`)
-	questionExp := regexp.MustCompile(`(?i)^.*(gooby|губи|губ(я)+н).*\?$`)
-	commandExp := regexp.MustCompile(`(?i)^(gooby|губи|губ(я)+н),.*$`)
-	dotkaExp := regexp.MustCompile(`(?i)^.*(dota|дота|дот((ец)|(к)+(а|у))).*$`)
-	majorExp := regexp.MustCompile(`(?i)^.*(товаризч|(товарищ(ь)?)\s+(майор|генерал|старшина|адмирал|капитан)).*$`)
-	// highlightedExp := regexp.MustCompile(`(?i)^.*(gooby|губи|губ(я)+н).*$`)
-
-	switch {
-	case techExp.MatchString(message.Text):
+
+	if techExp.MatchString(message.Text) {
 		bot.Send(message.Chat,
 			"ТТХ: "+registry.Config.ReplyTechLink,
 			&telebot.SendOptions{DisableWebPagePreview: true, DisableNotification: true})
+		return
+	}
 
-	case questionExp.MatchString(message.Text):
-		replyText := askChatGpt(message)
-
-		if replyText == "" {
-			switch {
-			case rngInt%100 == 0:
-				replyText = "Заткнись, пидор"
-			case rngInt%2 == 0:
-				replyText = "Да"
-			default:
-				replyText = "Нет"
-			}
-		}
-
-		bot.Send(message.Chat, replyText, &telebot.SendOptions{ReplyTo: message})
-
-	case commandExp.MatchString(message.Text):
-		replyText := askChatGpt(message)
-
-		if replyText != "" {
-			bot.Send(message.Chat, replyText, &telebot.SendOptions{ReplyTo: message})
-		}
-
-	case dotkaExp.MatchString(message.Text):
-		if rngInt%50 == 0 {
-			bot.Send(message.Chat, "Щяб в дотку!", &telebot.SendOptions{})
-		}
-
-	case majorExp.MatchString(message.Text):
-		if rngInt%50 == 0 {
-			bot.Send(message.Chat, "Так точно!", &telebot.SendOptions{ReplyTo: message})
-		} else {
-			bot.Send(message.Chat, "Я за него.", &telebot.SendOptions{ReplyTo: message})
-		}
-
-		// case highlightedExp.MatchString(message.Text):
-		// 	bot.Send(message.Chat, "herp derp", nil)
-
-	default:
-		if rngInt%100 == 0 && len(message.Text) > 150 {
-			replyText := askChatGpt(message)
-
-			if replyText != "" {
-				bot.Send(message.Chat, replyText, &telebot.SendOptions{ReplyTo: message})
-			}
-		}
+	if match := personaExp.FindStringSubmatch(message.Text); match != nil {
+		handlePersonaCommand(message, match[3])
+		return
 	}
+
+	applyRules(message)
 }
 
 func retrieveHistoryForChat(chatID int64, messageCount int) []telebot.Message {
 	rows, err := sqliteDb.Query(
-		`SELECT data FROM messages 
+		`SELECT data, COALESCE(text, '') FROM messages 
 		WHERE chat_id = ? 
 		ORDER BY unixtime DESC LIMIT ?`,
 		chatID, messageCount)
@@ -126,8 +98,8 @@ func retrieveHistoryForChat(chatID int64, messageCount int) []telebot.Message {
 
 	var messages []telebot.Message
 	for rows.Next() {
-		var data string
-		if err := rows.Scan(&data); err != nil {
+		var data, text string
+		if err := rows.Scan(&data, &text); err != nil {
 			log.Printf("Error scanning message: %v", err)
 			continue
 		}
@@ -137,6 +109,11 @@ func retrieveHistoryForChat(chatID int64, messageCount int) []telebot.Message {
 			log.Printf("Error unmarshaling message: %v", err)
 			continue
 		}
+
+		// Voice messages get their text from the transcript
+		if msg.Text == "" {
+			msg.Text = text
+		}
 		messages = append(messages, msg)
 	}
 
@@ -166,54 +143,112 @@ func generateChatGptHistory(messages []telebot.Message) string {
 	return history
 }
 
-func askChatGpt(message *telebot.Message) string {
-	question := message.Text
+// askChatGpt answers the message, budget and rate limit errors are returned
+// so the caller decides whether the refusal is worth posting. Unsolicited
+// questions only get the local input checks and errBlocked instead of the blocked reply.
+func askChatGpt(message *telebot.Message, solicited bool) (string, error) {
+	call := ai.NewCall(message.Chat.ID, message.Sender.ID, "reply")
 
-	var config openai.ClientConfig
-	var model string
+	review := moderation.Review
+	if !solicited {
+		review = moderation.ReviewLocal
+	}
 
-	if registry.Config.AiProvider == "openrouter" {
-		config = openai.DefaultConfig(registry.Config.OpenrouterApiKey)
-		config.BaseURL = "https://openrouter.ai/api/v1"
-		model = registry.Config.AiModel
-	} else {
-		config = openai.DefaultConfig(registry.Config.OpenaiApiKey)
-		model = "gpt-4o-mini"
+	question, allowed := review(call, "input", messageText(message))
+	if !allowed {
+		return blockedReply(solicited)
 	}
 
-	client := openai.NewClientWithConfig(config)
+	p := chatPersona(message.Chat.ID)
+	data := newPromptData(message, p.Language, question)
+
+	// Start with the persona system prompt
+	systemMessage := renderPrompt(p.SystemPrompt, data)
 
-	// Start with global system prompt
-	systemMessage := registry.Config.ChatGptSystemPrompt
+	// The cache key covers the prompt templates rather than the rendered prompts,
+	// which differ for every sender and day
+	prompts := p.SystemPrompt + "\x00" + p.UserPrompt + "\x00" + p.Language
 
 	// Add chat-specific prompt if it exists
 	for _, chatConfig := range registry.Config.ChatGptConfigPerChat {
 		if chatConfig.ChatID == message.Chat.ID && chatConfig.SystemPrompt != "" {
-			systemMessage += "\n\n" + chatConfig.SystemPrompt
+			systemMessage += "\n\n" + renderPrompt(chatConfig.SystemPrompt, data)
+			prompts += "\x00" + chatConfig.SystemPrompt
 			break
 		}
 	}
 
-	userMessage := fmt.Sprintf(registry.Config.ChatGptUserPrompt, question)
+	if p.Language != "" {
+		systemMessage += "\n\nОтвечай на языке: " + p.Language
+	}
+
+	userMessage := renderUserPrompt(p.UserPrompt, data)
 
-	log.Printf("ChatGPT request: model %v", model)
-	log.Printf("ChatGPT request: chat_id %v", message.Chat.ID)
+	log.Printf("ChatGPT request: chat_id %v, persona %v", message.Chat.ID, p.name)
 	log.Printf("ChatGPT request: system %v", systemMessage)
 	log.Printf("ChatGPT request: user %v", userMessage)
 
+	exclude := map[int]bool{message.ID: true}
+	cacheParts := []string{strconv.FormatInt(message.Chat.ID, 10), ai.HashText(prompts)}
+
+	// Answers built from the chat's own messages aren't reused
+	cacheable := true
+
 	if registry.Config.ChatGptUseHistory {
-		history := generateChatGptHistory(retrieveHistoryForChat(message.Chat.ID, registry.Config.ChatGptHistoryDepth))
+		historyMessages := retrieveHistoryForChat(message.Chat.ID, p.HistoryDepth)
+		history := generateChatGptHistory(historyMessages)
 
 		log.Printf("ChatGPT request: history %v", history)
 
 		systemMessage += "\n\nВ чате произошел следующий диалог: \n" + history
+		cacheParts = append(cacheParts, ai.HashText(history))
+
+		for _, historyMessage := range historyMessages {
+			exclude[historyMessage.ID] = true
+		}
+	}
+
+	if registry.Config.UserMemory.Enabled {
+		if memories := relevantMemories(message.Sender.ID, message.Chat.ID, question); len(memories) > 0 {
+			log.Printf("ChatGPT request: %v memories about the sender", len(memories))
+
+			systemMessage += "\n\nЧто ты знаешь о собеседнике (" + data.SenderName + "): \n" + formatMemories(memories)
+			cacheParts = append(cacheParts, ai.HashText(formatMemories(memories)))
+		}
+	}
+
+	if registry.Config.SemanticMemory.Enabled {
+		if snippets := findSnippets(call, question, exclude); len(snippets) > 0 {
+			log.Printf("ChatGPT request: %v relevant snippets", len(snippets))
+
+			systemMessage += "\n\nРанее в чате писали на эту тему: \n" + formatSnippets(snippets)
+			cacheParts = append(cacheParts, ai.HashText(formatSnippets(snippets)))
+			cacheable = false
+		}
+	}
+
+	// Identical questions to the same persona in the same chat get the same answer.
+	// With the history on its hash is part of the key, so hits are rare in an active chat.
+	model := p.Model
+	if model == "" {
+		_, model = ai.NewClient()
+	}
+
+	var cacheKey string
+	if photo, _ := attachedPhoto(message); photo == nil && cacheable {
+		cacheKey = ai.CacheKey(question, append([]string{model, p.name}, cacheParts...)...)
+
+		if cached, ok := ai.CachedResponse(cacheKey); ok {
+			return cached, nil
+		}
 	}
 
-	resp, err := client.CreateChatCompletion(
+	replyText, usedTools, err := completeWithTools(
 		context.Background(),
+		call,
 		openai.ChatCompletionRequest{
-			Model:            model,
-			Temperature:      0.7,
+			Model:            p.Model,
+			Temperature:      requestTemperature(*p.Temperature),
 			TopP:             1.0,
 			FrequencyPenalty: 0.2,
 			PresencePenalty:  0.2,
@@ -223,18 +258,45 @@ func askChatGpt(message *telebot.Message) string {
 					Role:    openai.ChatMessageRoleSystem,
 					Content: systemMessage,
 				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: userMessage,
-				},
+				buildUserMessage(message, userMessage, p.Model),
 			},
 		},
 	)
 
 	if err != nil {
 		log.Printf("ChatCompletion error: %v", err)
-		return ""
+		return "", err
+	}
+
+	replyText, allowed = moderation.Review(call, "output", replyText)
+	if !allowed {
+		return blockedReply(solicited)
+	}
+
+	// Tool results may change any moment
+	if cacheKey != "" && !usedTools {
+		ai.CacheResponse(cacheKey, model, p.name, replyText)
+	}
+
+	return replyText, nil
+}
+
+// blockedReply tells those who asked that the question or the answer was blocked,
+// the bot keeps quiet about the messages it picked up on its own
+func blockedReply(solicited bool) (string, error) {
+	if !solicited {
+		return "", errBlocked
+	}
+
+	return moderation.BlockedReply(), nil
+}
+
+// requestTemperature keeps a zero temperature from being dropped as an empty field,
+// which would make the provider use its own default
+func requestTemperature(temperature float32) float32 {
+	if temperature == 0 {
+		return math.SmallestNonzeroFloat32
 	}
 
-	return resp.Choices[0].Message.Content
+	return temperature
 }
@@ -0,0 +1,286 @@
+package reply
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type rule struct {
+	registry.ReplyRule
+	exp *regexp.Regexp
+}
+
+var rules []rule
+var cooldowns = map[string]time.Time{}
+var cooldownsMutex sync.Mutex
+
+// defaultRules reproduces the original hardcoded triggers and is used
+// when reply_rules is missing from the config
+func defaultRules() []registry.ReplyRule {
+	return []registry.ReplyRule{
+		{
+			Name:        "question",
+			Pattern:     `(?i)^.*(gooby|губи|губ(я)+н).*\?$`,
+			Action:      "ask_ai",
+			Replies:     []string{"Да", "Нет"},
+			RareReplies: []string{"Заткнись, пидор"},
+			RareChance:  100,
+			ReplyTo:     true,
+		},
+		{
+			Name:    "command",
+			Pattern: `(?i)^(gooby|губи|губ(я)+н),.*$`,
+			Action:  "ask_ai",
+			ReplyTo: true,
+		},
+		{
+			Name:    "dotka",
+			Pattern: `(?i)^.*(dota|дота|дот((ец)|(к)+(а|у))).*$`,
+			Chance:  50,
+			Replies: []string{"Щяб в дотку!"},
+		},
+		{
+			Name:        "major",
+			Pattern:     `(?i)^.*(товаризч|(товарищ(ь)?)\s+(майор|генерал|старшина|адмирал|капитан)).*$`,
+			Chance:      50,
+			Replies:     []string{"Так точно!"},
+			MissReplies: []string{"Я за него."},
+			ReplyTo:     true,
+		},
+		{
+			Name:      "random",
+			Chance:    100,
+			MinLength: 150,
+			Action:    "ask_ai",
+			ReplyTo:   true,
+		},
+	}
+}
+
+func loadRules() {
+	configured := registry.Config.ReplyRules
+	if len(configured) == 0 {
+		configured = defaultRules()
+	}
+
+	rules = make([]rule, 0, len(configured))
+
+	for i, r := range configured {
+		if r.Name == "" {
+			r.Name = "rule" + strconv.Itoa(i)
+		}
+
+		compiled := rule{ReplyRule: r}
+
+		switch r.Match {
+		case "", "regex":
+			exp, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				log.Printf("Reply: skipping rule %v, bad pattern: %v", r.Name, err)
+				continue
+			}
+			compiled.exp = exp
+		case "contains", "prefix", "suffix", "exact":
+		default:
+			log.Printf("Reply: skipping rule %v, unknown match %q", r.Name, r.Match)
+			continue
+		}
+
+		rules = append(rules, compiled)
+	}
+
+	log.Printf("Reply: loaded %v rules", len(rules))
+}
+
+func (r *rule) appliesTo(chatID int64) bool {
+	if len(r.ChatIDs) == 0 {
+		return true
+	}
+
+	for _, id := range r.ChatIDs {
+		if id == chatID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *rule) matches(text string) bool {
+	if len(text) < r.MinLength {
+		return false
+	}
+
+	lowerText := strings.ToLower(text)
+	lowerPattern := strings.ToLower(r.Pattern)
+
+	switch r.Match {
+	case "contains":
+		return strings.Contains(lowerText, lowerPattern)
+	case "prefix":
+		return strings.HasPrefix(lowerText, lowerPattern)
+	case "suffix":
+		return strings.HasSuffix(lowerText, lowerPattern)
+	case "exact":
+		return lowerText == lowerPattern
+	default:
+		return r.exp.MatchString(text)
+	}
+}
+
+// coolingDown reports whether the rule has fired in this chat recently
+func (r *rule) coolingDown(chatID int64) bool {
+	if r.Cooldown <= 0 {
+		return false
+	}
+
+	cooldownsMutex.Lock()
+	defer cooldownsMutex.Unlock()
+
+	last, ok := cooldowns[r.Name+":"+strconv.FormatInt(chatID, 10)]
+	return ok && time.Since(last) < r.Cooldown
+}
+
+func (r *rule) markFired(chatID int64) {
+	if r.Cooldown <= 0 {
+		return
+	}
+
+	cooldownsMutex.Lock()
+	defer cooldownsMutex.Unlock()
+
+	cooldowns[r.Name+":"+strconv.FormatInt(chatID, 10)] = time.Now()
+}
+
+// unsolicited reports whether the rule fires without anyone calling the bot,
+// a rule without a pattern matches any long enough message
+func (r *rule) unsolicited() bool {
+	return r.Pattern == ""
+}
+
+func (r *rule) roll() bool {
+	if r.Chance <= 1 {
+		return true
+	}
+
+	return rng.Intn(r.Chance) == 0
+}
+
+// applyRules handles the message with the first rule whose pattern matches,
+// later rules aren't tried even when its chance or cooldown keeps it silent.
+// It returns false if no rule matched.
+func applyRules(message *telebot.Message) bool {
+	for i := range rules {
+		r := &rules[i]
+
+		if !r.appliesTo(message.Chat.ID) || !r.matches(messageText(message)) {
+			continue
+		}
+
+		if r.coolingDown(message.Chat.ID) {
+			return true
+		}
+
+		if !r.roll() {
+			r.sendMiss(message)
+			return true
+		}
+
+		log.Printf("Reply: rule %v fired", r.Name)
+		r.markFired(message.Chat.ID)
+		r.execute(message)
+
+		return true
+	}
+
+	return false
+}
+
+// sendMiss answers with one of the miss replies when the chance roll fails
+func (r *rule) sendMiss(message *telebot.Message) {
+	if len(r.MissReplies) == 0 {
+		return
+	}
+
+	options := &telebot.SendOptions{}
+	if r.ReplyTo {
+		options.ReplyTo = message
+	}
+
+	registry.Bot.Send(message.Chat, r.MissReplies[rng.Intn(len(r.MissReplies))], options)
+}
+
+func (r *rule) execute(message *telebot.Message) {
+	bot := registry.Bot
+
+	options := &telebot.SendOptions{}
+	if r.ReplyTo {
+		options.ReplyTo = message
+	}
+
+	switch r.Action {
+	case "sticker":
+		if len(r.Stickers) == 0 {
+			return
+		}
+		sticker := &telebot.Sticker{File: telebot.File{FileID: r.Stickers[rng.Intn(len(r.Stickers))]}}
+		bot.Send(message.Chat, sticker, options)
+
+	case "ask_ai":
+		replyText, err := askChatGpt(message, !r.unsolicited())
+		if err == errBlocked {
+			return
+		}
+
+		// Only those who called the bot hear the refusal, unsolicited replies stay silent
+		if errors.Is(err, ai.ErrBudgetExceeded) || errors.Is(err, ai.ErrRateLimited) {
+			if !r.unsolicited() {
+				bot.Send(message.Chat, ai.Refusal(), options)
+			}
+			return
+		}
+
+		// Canned replies serve as a fallback when the provider fails
+		if replyText == "" {
+			replyText = r.pickReply()
+		}
+
+		if replyText != "" {
+			bot.SendFormatted(message.Chat, replyText, options)
+		}
+
+	default:
+		if generate, ok := registry.Generators[r.Action]; ok {
+			if replyText := generate(message.Chat.ID, 0); replyText != "" {
+				bot.Send(message.Chat, replyText, options)
+			}
+			return
+		}
+
+		if replyText := r.pickReply(); replyText != "" {
+			bot.Send(message.Chat, replyText, options)
+		}
+	}
+}
+
+func (r *rule) pickReply() string {
+	if len(r.RareReplies) > 0 && r.RareChance > 1 && rng.Intn(r.RareChance) == 0 {
+		return r.RareReplies[rng.Intn(len(r.RareReplies))]
+	}
+
+	if len(r.Replies) == 0 {
+		return ""
+	}
+
+	return r.Replies[rng.Intn(len(r.Replies))]
+}
@@ -0,0 +1,295 @@
+package reply
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type snippet struct {
+	messageID int
+	unixtime  int64
+	author    string
+	text      string
+	score     float32
+}
+
+func startSemanticMemory() {
+	config := &registry.Config.SemanticMemory
+
+	if !config.Enabled {
+		return
+	}
+
+	if config.Model == "" {
+		config.Model = "text-embedding-3-small"
+	}
+	if config.TopK <= 0 {
+		config.TopK = 5
+	}
+	if config.MinScore <= 0 {
+		config.MinScore = 0.3
+	}
+	if config.MinLength <= 0 {
+		config.MinLength = 20
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 64
+	}
+	if config.IndexInterval <= 0 {
+		config.IndexInterval = time.Minute
+	}
+	if config.MaxCandidates <= 0 {
+		config.MaxCandidates = 5000
+	}
+
+	go func() {
+		for {
+			indexMessages()
+			time.Sleep(config.IndexInterval)
+		}
+	}()
+}
+
+// indexMessages embeds messages that have no vector yet, newest first
+func indexMessages() {
+	config := registry.Config.SemanticMemory
+
+	for {
+		rows, err := database.DB.Query(
+			`SELECT m.id, m.chat_id, m.text
+			FROM messages m
+			LEFT JOIN message_embeddings e ON e.message_id = m.id AND e.chat_id = m.chat_id
+			WHERE e.message_id IS NULL AND length(m.text) >= ?
+			ORDER BY m.unixtime DESC
+			LIMIT ?`,
+			config.MinLength, config.BatchSize)
+		if err != nil {
+			log.Printf("Semantic: error loading messages: %v", err)
+			return
+		}
+
+		var ids []int
+		var chatIDs []int64
+		var texts []string
+		for rows.Next() {
+			var id int
+			var chatID int64
+			var text string
+			if err := rows.Scan(&id, &chatID, &text); err != nil {
+				log.Printf("Semantic: error scanning message: %v", err)
+				continue
+			}
+			ids = append(ids, id)
+			chatIDs = append(chatIDs, chatID)
+			texts = append(texts, strings.ReplaceAll(text, "\n", " "))
+		}
+		rows.Close()
+
+		if len(texts) == 0 {
+			return
+		}
+
+		vectors, err := embedBatch(texts, ids)
+		if err != nil {
+			log.Printf("Semantic: error computing embeddings: %v", err)
+			return
+		}
+
+		for i, vector := range vectors {
+			// Refused messages are saved without a vector so they aren't retried
+			var blob []byte
+			if vector != nil {
+				blob = encodeVector(vector)
+			}
+
+			_, err := database.DB.Exec(
+				"INSERT OR REPLACE INTO message_embeddings (message_id, chat_id, model, vector) VALUES (?, ?, ?, ?)",
+				ids[i], chatIDs[i], config.Model, blob)
+			if err != nil {
+				log.Printf("Semantic: error saving embedding: %v", err)
+				return
+			}
+		}
+
+		log.Printf("Semantic: indexed %v messages", len(vectors))
+
+		if len(texts) < config.BatchSize {
+			return
+		}
+	}
+}
+
+// embedBatch embeds the texts, when the provider refuses the batch they are sent
+// one by one and the refused ones get a nil vector
+func embedBatch(texts []string, ids []int) ([][]float32, error) {
+	call := ai.Call{Purpose: "embeddings"}
+
+	vectors, err := ai.Embed(context.Background(), call, texts)
+	if err == nil || !ai.IsRejected(err) {
+		return vectors, err
+	}
+
+	log.Printf("Semantic: batch refused, embedding one by one: %v", err)
+
+	vectors = make([][]float32, len(texts))
+	for i, text := range texts {
+		single, err := ai.Embed(context.Background(), call, []string{text})
+		if ai.IsRejected(err) {
+			log.Printf("Semantic: skipping message %v: %v", ids[i], err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		vectors[i] = single[0]
+	}
+
+	return vectors, nil
+}
+
+// findSnippets returns up to top_k messages closest to the question
+// among the latest max_candidates indexed messages of the chat
+func findSnippets(call ai.Call, question string, exclude map[int]bool) []snippet {
+	config := registry.Config.SemanticMemory
+	chatID := call.ChatID
+
+	call.Purpose = "embeddings"
+	vectors, err := ai.Embed(context.Background(), call, []string{strings.ReplaceAll(question, "\n", " ")})
+	if err != nil {
+		log.Printf("Semantic: error embedding question: %v", err)
+		return nil
+	}
+	query := normalize(vectors[0])
+
+	rows, err := database.DB.Query(
+		`SELECT e.message_id, e.vector, m.unixtime, m.text,
+			COALESCE(u.username, ''), COALESCE(u.first_name, ''), COALESCE(u.last_name, '')
+		FROM message_embeddings e
+		JOIN messages m ON m.id = e.message_id AND m.chat_id = e.chat_id
+		LEFT JOIN users u ON u.id = m.sender_id
+		WHERE e.chat_id = ? AND e.model = ? AND e.vector IS NOT NULL
+		ORDER BY m.unixtime DESC
+		LIMIT ?`,
+		chatID, config.Model, config.MaxCandidates)
+	if err != nil {
+		log.Printf("Semantic: error loading embeddings: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var snippets []snippet
+	for rows.Next() {
+		var s snippet
+		var blob []byte
+		var username, firstName, lastName string
+		if err := rows.Scan(&s.messageID, &blob, &s.unixtime, &s.text, &username, &firstName, &lastName); err != nil {
+			log.Printf("Semantic: error scanning embedding: %v", err)
+			continue
+		}
+
+		if exclude[s.messageID] {
+			continue
+		}
+
+		s.score = dot(query, decodeVector(blob))
+		if s.score < config.MinScore {
+			continue
+		}
+
+		s.author = username
+		if s.author == "" {
+			s.author = strings.TrimSpace(firstName + " " + lastName)
+		}
+
+		snippets = append(snippets, s)
+	}
+
+	sort.Slice(snippets, func(i, j int) bool {
+		return snippets[i].score > snippets[j].score
+	})
+
+	if len(snippets) > config.TopK {
+		snippets = snippets[:config.TopK]
+	}
+
+	// Present the snippets in chronological order
+	sort.Slice(snippets, func(i, j int) bool {
+		return snippets[i].unixtime < snippets[j].unixtime
+	})
+
+	return snippets
+}
+
+func formatSnippets(snippets []snippet) string {
+	var result string
+
+	for _, s := range snippets {
+		date := time.Unix(s.unixtime, 0).In(registry.Config.TimeLoc).Format("02.01.2006")
+		result += fmt.Sprintf("[%s] %s: %s\n", date, s.author, s.text)
+	}
+
+	return result
+}
+
+func normalize(vector []float32) []float32 {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+
+	norm := float32(math.Sqrt(sum))
+	if norm == 0 {
+		return vector
+	}
+
+	normalized := make([]float32, len(vector))
+	for i, v := range vector {
+		normalized[i] = v / norm
+	}
+
+	return normalized
+}
+
+func dot(a []float32, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+
+	return sum
+}
+
+func encodeVector(vector []float32) []byte {
+	vector = normalize(vector)
+	blob := make([]byte, 4*len(vector))
+
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(v))
+	}
+
+	return blob
+}
+
+func decodeVector(blob []byte) []float32 {
+	vector := make([]float32, len(blob)/4)
+
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:]))
+	}
+
+	return vector
+}
@@ -0,0 +1,131 @@
+package reply
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+// embeddingsStub answers with one dimension per keyword and refuses
+// any input containing "HUGE" the way the API refuses oversized input
+func embeddingsStub(t *testing.T, calls *int32) *httptest.Server {
+	keywords := []string{"cat", "dog", "car"}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		if r.URL.Path != "/embeddings" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		var request struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decoding request: %v", err)
+			return
+		}
+
+		type embedding struct {
+			Object    string    `json:"object"`
+			Embedding []float32 `json:"embedding"`
+			Index     int       `json:"index"`
+		}
+		var data []embedding
+		for i, input := range request.Input {
+			if strings.Contains(input, "HUGE") {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": {"message": "input too long", "type": "invalid_request_error"}}`))
+				return
+			}
+
+			vector := []float32{0.1}
+			for _, keyword := range keywords {
+				vector = append(vector, float32(strings.Count(strings.ToLower(input), keyword)))
+			}
+			data = append(data, embedding{Object: "embedding", Embedding: vector, Index: i})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   data,
+			"model":  "test-embedding",
+			"usage":  map[string]int{"prompt_tokens": len(request.Input), "total_tokens": len(request.Input)},
+		})
+	}))
+}
+
+func TestSemanticMemoryIndexAndSearch(t *testing.T) {
+	var calls int32
+	server := embeddingsStub(t, &calls)
+	defer server.Close()
+
+	registry.Config.SemanticMemory = registry.SemanticMemoryConfig{
+		Enabled:       true,
+		Model:         "test-embedding",
+		BaseURL:       server.URL,
+		ApiKey:        "test",
+		TopK:          2,
+		MinScore:      0.5,
+		MinLength:     10,
+		BatchSize:     64,
+		MaxCandidates: 100,
+	}
+
+	const chatID = int64(-1001)
+	messages := []string{
+		"My cat sleeps on the keyboard again",
+		"The dog ate my homework, honestly",
+		"HUGE paste that the provider refuses",
+		"short",
+	}
+	for i, text := range messages {
+		_, err := database.DB.Exec(
+			"INSERT INTO messages (id, chat_id, sender_id, unixtime, text) VALUES (?, ?, ?, ?, ?)",
+			i+1, chatID, 42, 1700000000+i, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexMessages()
+
+	var indexed, refused int
+	err := database.DB.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(vector IS NULL), 0) FROM message_embeddings WHERE chat_id = ?`,
+		chatID).Scan(&indexed, &refused)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 3 || refused != 1 {
+		t.Fatalf("got %d indexed and %d refused messages, want 3 and 1", indexed, refused)
+	}
+
+	// The refused message must not be sent again
+	atomic.StoreInt32(&calls, 0)
+	indexMessages()
+	if calls != 0 {
+		t.Errorf("second indexing made %d requests, want none", calls)
+	}
+
+	snippets := findSnippets(ai.Call{ChatID: chatID}, "what does the cat do?", nil)
+	if len(snippets) != 1 || snippets[0].messageID != 1 {
+		t.Fatalf("got snippets %+v, want only message 1", snippets)
+	}
+
+	snippets = findSnippets(ai.Call{ChatID: chatID}, "what does the cat do?", map[int]bool{1: true})
+	if len(snippets) != 0 {
+		t.Errorf("got snippets %+v for an excluded message, want none", snippets)
+	}
+}
@@ -0,0 +1,172 @@
+package reply
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+func init() {
+	registry.RegisterTool(registry.Tool{
+		Name:        "search_chat_history",
+		Description: "Search messages of the current chat containing the given text. Returns dates, authors and messages, newest first.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query": map[string]interface{}{
+					"type":        "string",
+					"description": "Text to look for, a word or a short phrase",
+				},
+				"limit": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of messages to return, up to 20",
+				},
+			},
+			"required": []string{"query"},
+		},
+		Handler: searchChatHistory,
+	})
+}
+
+func searchChatHistory(chatID int64, arguments string) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(args.Query) == "" {
+		return "", fmt.Errorf("query is empty")
+	}
+	if args.Limit <= 0 || args.Limit > 20 {
+		args.Limit = 20
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT m.unixtime, m.text, COALESCE(u.username, ''), COALESCE(u.first_name, ''), COALESCE(u.last_name, '')
+		FROM messages m
+		LEFT JOIN users u ON u.id = m.sender_id
+		WHERE m.chat_id = ? AND m.text LIKE '%' || ? || '%'
+		ORDER BY m.unixtime DESC
+		LIMIT ?`,
+		chatID, args.Query, args.Limit)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var result string
+	for rows.Next() {
+		var unixtime int64
+		var text, username, firstName, lastName string
+		if err := rows.Scan(&unixtime, &text, &username, &firstName, &lastName); err != nil {
+			return "", err
+		}
+
+		author := username
+		if author == "" {
+			author = strings.TrimSpace(firstName + " " + lastName)
+		}
+		date := time.Unix(unixtime, 0).In(registry.Config.TimeLoc).Format("02.01.2006 15:04")
+		result += fmt.Sprintf("[%s] %s: %s\n", date, author, text)
+	}
+
+	if result == "" {
+		return "No messages found", nil
+	}
+
+	return result, nil
+}
+
+func availableTools() []openai.Tool {
+	if !registry.Config.AiUseTools {
+		return nil
+	}
+
+	var tools []openai.Tool
+	for _, name := range registry.ToolNames() {
+		tool := registry.Tools[name]
+		tools = append(tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	return tools
+}
+
+// completeWithTools runs the completion, executing the tools the model asks for
+// until it answers with text or runs out of tool-call rounds. It also reports
+// whether any tool was called.
+func completeWithTools(ctx context.Context, call ai.Call, req openai.ChatCompletionRequest) (string, bool, error) {
+	req.Tools = availableTools()
+
+	maxRounds := registry.Config.AiMaxToolRounds
+	if maxRounds <= 0 {
+		maxRounds = 3
+	}
+
+	for round := 0; ; round++ {
+		// Make the model answer once the cap is reached
+		if len(req.Tools) > 0 && round >= maxRounds {
+			req.ToolChoice = "none"
+		}
+
+		resp, err := ai.CreateChatCompletion(ctx, call, req)
+		if err != nil {
+			return "", round > 0, err
+		}
+
+		reply := resp.Choices[0].Message
+		if len(reply.ToolCalls) == 0 || req.ToolChoice == "none" {
+			return reply.Content, round > 0, nil
+		}
+
+		req.Messages = append(req.Messages, reply)
+
+		for _, toolCall := range reply.ToolCalls {
+			req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    callTool(call.ChatID, toolCall),
+				ToolCallID: toolCall.ID,
+			})
+		}
+	}
+}
+
+func callTool(chatID int64, call openai.ToolCall) string {
+	log.Printf("ChatGPT tool call: %v %v", call.Function.Name, call.Function.Arguments)
+
+	tool, ok := registry.Tools[call.Function.Name]
+	if !ok {
+		return "Error: unknown tool " + call.Function.Name
+	}
+
+	arguments := call.Function.Arguments
+	if arguments == "" {
+		arguments = "{}"
+	}
+
+	result, err := tool.Handler(chatID, arguments)
+	if err != nil {
+		log.Printf("ChatGPT tool error: %v", err)
+		return "Error: " + err.Error()
+	}
+
+	return result
+}
@@ -0,0 +1,203 @@
+package summary
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/moderation"
+	"github.com/focusshifter/muxgoob/registry"
+	"github.com/focusshifter/muxgoob/scheduler"
+)
+
+func startDigests() {
+	for _, digest := range registry.Config.Summary.Digests {
+		chatID := digest.ChatID
+		scheduler.Daily("digest:"+strconv.FormatInt(chatID, 10), digest.Time, registry.Config.TimeLoc,
+			func(day time.Time) error {
+				return postDigest(chatID, day)
+			})
+	}
+}
+
+// postDigest sends the digest of the day before the given one
+func postDigest(chatID int64, day time.Time) error {
+	since := day.AddDate(0, 0, -1)
+	from, until := since.Unix(), day.Unix()
+
+	lines := loadLines(chatID, from, until, registry.Config.Summary.MaxMessages)
+	if len(lines) == 0 {
+		log.Printf("Summary: no messages in chat %v on %v, skipping digest", chatID, since.Format("02.01.2006"))
+		return nil
+	}
+
+	call := ai.Call{ChatID: chatID, Purpose: "digest"}
+	summary, err := summarize(context.Background(), call, lines)
+	if err != nil {
+		return err
+	}
+
+	var digest strings.Builder
+	digest.WriteString("Digest for " + since.Format("02.01.2006"))
+
+	// A blocked summary is left out, the stats are still posted
+	if summary, allowed := moderation.Review(call, "output", summary); allowed {
+		digest.WriteString("\n\n" + summary)
+	}
+
+	if links := topLinks(chatID, from, until, 5); len(links) > 0 {
+		digest.WriteString("\n\nTop links:\n" + strings.Join(links, "\n"))
+	}
+
+	if members := activeMembers(chatID, from, until, 5); len(members) > 0 {
+		digest.WriteString("\n\nMost active:\n" + strings.Join(members, "\n"))
+	}
+
+	if media := mediaStats(chatID, from, until); media != "" {
+		digest.WriteString("\n\nMedia: " + media)
+
+		if link := notableMedia(chatID, from, until); link != "" {
+			digest.WriteString("\nMost discussed: " + link)
+		}
+	}
+
+	chat := &telebot.Chat{ID: chatID}
+	_, err = registry.Bot.SendFormatted(chat, digest.String(), &telebot.SendOptions{DisableWebPagePreview: true})
+
+	return err
+}
+
+// topLinks returns links first posted in the period, most replied to first
+func topLinks(chatID int64, from int64, until int64, limit int) []string {
+	rows, err := database.DB.Query(
+		`SELECT d.url, COUNT(r.id) AS replies
+		FROM dupe_links d
+		LEFT JOIN messages r ON r.chat_id = d.chat_id AND r.reply_to_message_id = d.message_id
+		WHERE d.chat_id = ? AND d.unixtime >= ? AND d.unixtime < ? AND d.url NOT LIKE 'forward:%'
+		GROUP BY d.id
+		ORDER BY replies DESC, d.unixtime ASC
+		LIMIT ?`,
+		chatID, from, until, limit)
+	if err != nil {
+		log.Printf("Summary: error loading links: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var links []string
+	for rows.Next() {
+		var url string
+		var replies int
+		if err := rows.Scan(&url, &replies); err != nil {
+			log.Printf("Summary: error scanning link: %v", err)
+			continue
+		}
+
+		line := fmt.Sprintf("%d. %s", len(links)+1, url)
+		if replies > 0 {
+			line += fmt.Sprintf(" (%d replies)", replies)
+		}
+		links = append(links, line)
+	}
+
+	return links
+}
+
+// activeMembers returns the members with the most messages in the period
+func activeMembers(chatID int64, from int64, until int64, limit int) []string {
+	rows, err := database.DB.Query(
+		`SELECT COALESCE(u.username, ''), COALESCE(u.first_name, ''), COALESCE(u.last_name, ''), COUNT(*) AS total
+		FROM messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.chat_id = ? AND m.unixtime >= ? AND m.unixtime < ? AND m.sender_id != ?
+		GROUP BY m.sender_id
+		ORDER BY total DESC
+		LIMIT ?`,
+		chatID, from, until, registry.Bot.Me.ID, limit)
+	if err != nil {
+		log.Printf("Summary: error loading members: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var username, firstName, lastName string
+		var total int
+		if err := rows.Scan(&username, &firstName, &lastName, &total); err != nil {
+			log.Printf("Summary: error scanning member: %v", err)
+			continue
+		}
+
+		name := strings.TrimSpace(firstName + " " + lastName)
+		if name == "" {
+			name = username
+		}
+		members = append(members, fmt.Sprintf("%s — %d", name, total))
+	}
+
+	return members
+}
+
+// mediaStats counts media items of every type posted in the period
+func mediaStats(chatID int64, from int64, until int64) string {
+	rows, err := database.DB.Query(
+		`SELECT i.type, COUNT(*) AS total
+		FROM media_items i
+		JOIN messages m ON m.id = i.message_id AND m.chat_id = i.chat_id
+		WHERE i.chat_id = ? AND m.unixtime >= ? AND m.unixtime < ?
+		GROUP BY i.type
+		ORDER BY total DESC`,
+		chatID, from, until)
+	if err != nil {
+		log.Printf("Summary: error loading media: %v", err)
+		return ""
+	}
+	defer rows.Close()
+
+	var stats []string
+	for rows.Next() {
+		var mediaType string
+		var total int
+		if err := rows.Scan(&mediaType, &total); err != nil {
+			log.Printf("Summary: error scanning media: %v", err)
+			continue
+		}
+		stats = append(stats, fmt.Sprintf("%d × %s", total, mediaType))
+	}
+
+	return strings.Join(stats, ", ")
+}
+
+// notableMedia links to the most replied media message of the period,
+// only supergroups have public message links
+func notableMedia(chatID int64, from int64, until int64) string {
+	internalID := strings.TrimPrefix(strconv.FormatInt(chatID, 10), "-100")
+	if internalID == strconv.FormatInt(chatID, 10) {
+		return ""
+	}
+
+	var messageID, replies int
+	err := database.DB.QueryRow(
+		`SELECT i.message_id, COUNT(r.id) AS replies
+		FROM media_items i
+		JOIN messages m ON m.id = i.message_id AND m.chat_id = i.chat_id
+		JOIN messages r ON r.chat_id = i.chat_id AND r.reply_to_message_id = i.message_id
+		WHERE i.chat_id = ? AND m.unixtime >= ? AND m.unixtime < ?
+		GROUP BY i.message_id
+		ORDER BY replies DESC
+		LIMIT 1`,
+		chatID, from, until).Scan(&messageID, &replies)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("https://t.me/c/%s/%d (%d replies)", internalID, messageID, replies)
+}
@@ -0,0 +1,234 @@
+package summary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/moderation"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type SummaryPlugin struct {
+}
+
+type chatLine struct {
+	unixtime int64
+	author   string
+	text     string
+}
+
+var tldrExp = regexp.MustCompile(`(?i)^\!(tldr|тлдр)(\s+(\d+)\s*(h|ч)?)?$`)
+
+func init() {
+	registry.RegisterPlugin(&SummaryPlugin{})
+}
+
+func (p *SummaryPlugin) Start(interface{}) {
+	config := &registry.Config.Summary
+
+	if config.DefaultMessages <= 0 {
+		config.DefaultMessages = 100
+	}
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = 1000
+	}
+	if config.MaxHours <= 0 {
+		config.MaxHours = 24
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = 12000
+	}
+	if config.Language == "" {
+		config.Language = "Russian"
+	}
+
+	startDigests()
+}
+
+func (p *SummaryPlugin) Process(message *telebot.Message) {
+	match := tldrExp.FindStringSubmatch(message.Text)
+	if match == nil {
+		return
+	}
+
+	bot := registry.Bot
+	config := registry.Config.Summary
+
+	var lines []chatLine
+	var header string
+
+	count, _ := strconv.Atoi(match[3])
+
+	if match[4] != "" {
+		hours := count
+		if hours <= 0 || hours > config.MaxHours {
+			hours = config.MaxHours
+		}
+		since := time.Now().Add(-time.Duration(hours) * time.Hour)
+		lines = loadLines(message.Chat.ID, since.Unix(), message.Unixtime, config.MaxMessages)
+		header = fmt.Sprintf("TL;DR for the last %d h:", hours)
+	} else {
+		if count <= 0 {
+			count = config.DefaultMessages
+		}
+		if count > config.MaxMessages {
+			count = config.MaxMessages
+		}
+		lines = loadLines(message.Chat.ID, 0, message.Unixtime, count)
+		header = fmt.Sprintf("TL;DR for the last %d messages:", len(lines))
+	}
+
+	if len(lines) == 0 {
+		bot.Send(message.Chat, "Nothing to summarize", &telebot.SendOptions{ReplyTo: message})
+		return
+	}
+
+	bot.Notify(message.Chat, telebot.Typing)
+
+	call := ai.NewCall(message.Chat.ID, message.Sender.ID, "tldr")
+	summary, err := summarize(context.Background(), call, lines)
+	if errors.Is(err, ai.ErrBudgetExceeded) || errors.Is(err, ai.ErrRateLimited) {
+		bot.Send(message.Chat, ai.Refusal(), &telebot.SendOptions{ReplyTo: message})
+		return
+	}
+	if err != nil {
+		log.Printf("Summary: error summarizing chat %v: %v", message.Chat.ID, err)
+		bot.Send(message.Chat, "Couldn't summarize the chat, try again later", &telebot.SendOptions{ReplyTo: message})
+		return
+	}
+
+	summary, allowed := moderation.Review(call, "output", summary)
+	if !allowed {
+		bot.Send(message.Chat, moderation.BlockedReply(), &telebot.SendOptions{ReplyTo: message})
+		return
+	}
+
+	bot.SendFormatted(message.Chat, header+"\n\n"+summary, &telebot.SendOptions{ReplyTo: message, DisableWebPagePreview: true})
+}
+
+// loadLines returns up to limit latest text messages of the chat
+// posted in [since, until), oldest first
+func loadLines(chatID int64, since int64, until int64, limit int) []chatLine {
+	rows, err := database.DB.Query(
+		`SELECT m.unixtime, COALESCE(NULLIF(m.text, ''), m.caption, ''),
+			COALESCE(u.username, ''), COALESCE(u.first_name, ''), COALESCE(u.last_name, '')
+		FROM messages m
+		LEFT JOIN users u ON u.id = m.sender_id
+		WHERE m.chat_id = ? AND m.unixtime >= ? AND m.unixtime < ?
+		ORDER BY m.unixtime DESC LIMIT ?`,
+		chatID, since, until, limit)
+	if err != nil {
+		log.Printf("Summary: error loading messages: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var lines []chatLine
+	for rows.Next() {
+		var line chatLine
+		var username, firstName, lastName string
+		if err := rows.Scan(&line.unixtime, &line.text, &username, &firstName, &lastName); err != nil {
+			log.Printf("Summary: error scanning message: %v", err)
+			continue
+		}
+
+		line.text = strings.TrimSpace(line.text)
+		if line.text == "" {
+			continue
+		}
+
+		line.author = strings.TrimSpace(firstName + " " + lastName)
+		if line.author == "" {
+			line.author = username
+		}
+
+		lines = append(lines, line)
+	}
+
+	// Reverse into chronological order
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+
+	return lines
+}
+
+// formatLines renders the chat log one message per line
+func formatLines(lines []chatLine) []string {
+	formatted := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		formatted = append(formatted, fmt.Sprintf("[%s] %s: %s\n",
+			time.Unix(line.unixtime, 0).In(registry.Config.TimeLoc).Format("15:04"), line.author, line.text))
+	}
+
+	return formatted
+}
+
+// chunkText joins parts into pieces of at most size characters
+func chunkText(parts []string, size int) []string {
+	var chunks []string
+	var current strings.Builder
+
+	for _, part := range parts {
+		if current.Len() > 0 && current.Len()+len(part) > size {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		current.WriteString(part)
+	}
+
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+
+	return chunks
+}
+
+// summarize runs a map-reduce summary over the chat log
+func summarize(ctx context.Context, call ai.Call, lines []chatLine) (string, error) {
+	config := registry.Config.Summary
+
+	mapPrompt := fmt.Sprintf(
+		"You summarize a fragment of a group chat log. List the discussed topics as short bullet points, "+
+			"mentioning who said what by name. Keep links and decisions. Answer in %s.", config.Language)
+	reducePrompt := fmt.Sprintf(
+		"You write a short digest of a group chat. Combine the notes into at most 10 bullet points, "+
+			"grouped by topic, mentioning who said what by name. Answer in %s. "+
+			"Do not use Markdown formatting.", config.Language)
+
+	chunks := chunkText(formatLines(lines), config.ChunkSize)
+
+	// Keep reducing until the notes fit into a single request
+	for len(chunks) > 1 {
+		log.Printf("Summary: summarizing %v chunks", len(chunks))
+
+		notes := make([]string, 0, len(chunks))
+		for _, chunk := range chunks {
+			note, err := ai.Ask(ctx, call, mapPrompt, chunk)
+			if err != nil {
+				return "", err
+			}
+			notes = append(notes, note+"\n\n")
+		}
+
+		next := chunkText(notes, config.ChunkSize)
+		if len(next) >= len(chunks) {
+			// Notes didn't get any shorter, reduce them in one go
+			next = []string{strings.Join(notes, "")}
+		}
+		chunks = next
+	}
+
+	return ai.Ask(ctx, call, reducePrompt, chunks[0])
+}
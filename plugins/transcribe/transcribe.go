@@ -0,0 +1,171 @@
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type TranscribePlugin struct {
+}
+
+type recording struct {
+	fileID   string
+	fileName string
+	duration int
+}
+
+var errTooLong = errors.New("recording is too long")
+
+var transcribeExp = regexp.MustCompile(`(?i)^\!(текст|text|transcribe)$`)
+
+func init() {
+	registry.RegisterPlugin(&TranscribePlugin{})
+}
+
+func (p *TranscribePlugin) Start(interface{}) {
+	config := &registry.Config.Transcription
+
+	if config.Model == "" {
+		config.Model = "whisper-1"
+	}
+	if config.MaxDuration <= 0 {
+		config.MaxDuration = 600
+	}
+}
+
+func (p *TranscribePlugin) Process(message *telebot.Message) {
+	if !registry.Config.Transcription.Enabled {
+		return
+	}
+
+	bot := registry.Bot
+
+	if transcribeExp.MatchString(message.Text) {
+		if message.ReplyTo == nil || recordingOf(message.ReplyTo) == nil {
+			bot.Send(message.Chat, "Ответьте этой командой на голосовое сообщение", &telebot.SendOptions{ReplyTo: message})
+			return
+		}
+
+		call := ai.NewCall(message.Chat.ID, message.Sender.ID, "transcription")
+		reply(message.ReplyTo, call)
+		return
+	}
+
+	if recordingOf(message) == nil {
+		return
+	}
+
+	call := ai.NewCall(message.Chat.ID, message.Sender.ID, "transcription")
+
+	switch chatMode(message.Chat.ID) {
+	case "reply":
+		reply(message, call)
+	case "store":
+		if _, err := transcript(message, call); err != nil {
+			log.Printf("Transcribe: error transcribing message %v: %v", message.ID, err)
+		}
+	}
+}
+
+func chatMode(chatID int64) string {
+	for _, chat := range registry.Config.Transcription.Chats {
+		if chat.ChatID == chatID {
+			return chat.Mode
+		}
+	}
+
+	return ""
+}
+
+func recordingOf(message *telebot.Message) *recording {
+	if message.Voice != nil {
+		return &recording{fileID: message.Voice.FileID, fileName: "voice.ogg", duration: message.Voice.Duration}
+	}
+
+	if message.VideoNote != nil {
+		return &recording{fileID: message.VideoNote.FileID, fileName: "video.mp4", duration: message.VideoNote.Duration}
+	}
+
+	return nil
+}
+
+// reply posts the transcript of the voice message in response to it
+func reply(message *telebot.Message, call ai.Call) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	bot.Notify(message.Chat, telebot.Typing)
+
+	text, err := transcript(message, call)
+	switch {
+	case errors.Is(err, ai.ErrBudgetExceeded) || errors.Is(err, ai.ErrRateLimited):
+		bot.Send(message.Chat, ai.Refusal(), options)
+	case errors.Is(err, errTooLong):
+		bot.Send(message.Chat, "Сообщение слишком длинное для расшифровки", options)
+	case err != nil:
+		log.Printf("Transcribe: error transcribing message %v: %v", message.ID, err)
+		bot.Send(message.Chat, "Не удалось расшифровать сообщение", options)
+	case text == "":
+		bot.Send(message.Chat, "🎤 (тишина)", options)
+	default:
+		bot.Send(message.Chat, "🎤 "+text, options)
+	}
+}
+
+// transcript returns the saved transcript of the message, transcribing it first if needed
+func transcript(message *telebot.Message, call ai.Call) (string, error) {
+	var text string
+	err := database.DB.QueryRow(
+		"SELECT text FROM transcripts WHERE message_id = ? AND chat_id = ?",
+		message.ID, message.Chat.ID).Scan(&text)
+	if err == nil {
+		return text, nil
+	}
+
+	rec := recordingOf(message)
+	if rec.duration > registry.Config.Transcription.MaxDuration {
+		return "", errTooLong
+	}
+
+	audio, err := registry.Bot.DownloadFile(rec.fileID)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	text, err = ai.Transcribe(ctx, call, rec.fileName, bytes.NewReader(audio), rec.duration)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Transcribe: transcribed message %v in chat %v", message.ID, message.Chat.ID)
+
+	_, err = database.DB.Exec(
+		"INSERT OR REPLACE INTO transcripts (message_id, chat_id, model, text, unixtime) VALUES (?, ?, ?, ?, ?)",
+		message.ID, message.Chat.ID, registry.Config.Transcription.Model, text, time.Now().Unix())
+	if err != nil {
+		log.Printf("Transcribe: error saving transcript: %v", err)
+	}
+
+	// Search, summaries and the reply history read messages.text
+	_, err = database.DB.Exec(
+		"UPDATE messages SET text = ? WHERE id = ? AND chat_id = ? AND COALESCE(text, '') = ''",
+		text, message.ID, message.Chat.ID)
+	if err != nil {
+		log.Printf("Transcribe: error updating message text: %v", err)
+	}
+
+	return text, nil
+}
@@ -0,0 +1,316 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/tucnak/telebot"
+
+	"github.com/focusshifter/muxgoob/ai"
+	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/moderation"
+	"github.com/focusshifter/muxgoob/registry"
+)
+
+type TranslatePlugin struct {
+}
+
+var trExp = regexp.MustCompile(`(?i)^\!(tr|перевод)(\s+(\S+))?$`)
+
+var languageNames = map[string]string{
+	"ru": "Russian",
+	"uk": "Ukrainian",
+	"ua": "Ukrainian",
+	"en": "English",
+}
+
+// Recent auto translations per chat, used for rate limiting
+var autoTranslations = map[int64][]time.Time{}
+var autoTranslationsMutex sync.Mutex
+
+func init() {
+	registry.RegisterPlugin(&TranslatePlugin{})
+}
+
+func (p *TranslatePlugin) Start(interface{}) {
+	config := &registry.Config.Translate
+
+	if config.DefaultLanguage == "" {
+		config.DefaultLanguage = "ru"
+	}
+	if config.MinLength <= 0 {
+		config.MinLength = 20
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = time.Minute
+	}
+	if config.MaxPerHour <= 0 {
+		config.MaxPerHour = 20
+	}
+
+	for i, chat := range config.Chats {
+		if chat.Language == "" {
+			log.Printf("Translate: chat %v has no language, using %v", chat.ChatID, config.DefaultLanguage)
+			config.Chats[i].Language = config.DefaultLanguage
+		}
+	}
+}
+
+func (p *TranslatePlugin) Process(message *telebot.Message) {
+	if match := trExp.FindStringSubmatch(message.Text); match != nil {
+		translateReplied(message, match[3])
+		return
+	}
+
+	autoTranslate(message)
+}
+
+// chatLanguage returns the primary language of the chat and whether auto-translate is on
+func chatLanguage(chatID int64) (string, bool) {
+	for _, chat := range registry.Config.Translate.Chats {
+		if chat.ChatID == chatID {
+			return chat.Language, chat.Auto
+		}
+	}
+
+	return registry.Config.Translate.DefaultLanguage, false
+}
+
+func translateReplied(message *telebot.Message, language string) {
+	bot := registry.Bot
+	options := &telebot.SendOptions{ReplyTo: message}
+
+	if message.ReplyTo == nil {
+		bot.Send(message.Chat, "Ответьте этой командой на сообщение, которое нужно перевести", options)
+		return
+	}
+
+	text := repliedText(message.ReplyTo)
+	if text == "" {
+		bot.Send(message.Chat, "Нечего переводить", options)
+		return
+	}
+
+	if language == "" {
+		language, _ = chatLanguage(message.Chat.ID)
+	}
+
+	bot.Notify(message.Chat, telebot.Typing)
+
+	call := ai.NewCall(message.Chat.ID, message.Sender.ID, "translate")
+	translation, err := translate(call, text, language)
+	if errors.Is(err, ai.ErrBudgetExceeded) || errors.Is(err, ai.ErrRateLimited) {
+		bot.Send(message.Chat, ai.Refusal(), options)
+		return
+	}
+	if err != nil {
+		log.Printf("Translate: error translating message %v: %v", message.ReplyTo.ID, err)
+		bot.Send(message.Chat, "Не удалось перевести", options)
+		return
+	}
+
+	translation, allowed := moderation.Review(call, "output", translation)
+	if !allowed {
+		bot.Send(message.Chat, moderation.BlockedReply(), options)
+		return
+	}
+
+	bot.Send(message.Chat, "🌐 "+translation, &telebot.SendOptions{ReplyTo: message.ReplyTo})
+}
+
+// repliedText returns the text, the caption or the voice transcript of the message
+func repliedText(message *telebot.Message) string {
+	if message.Text != "" {
+		return message.Text
+	}
+	if message.Caption != "" {
+		return message.Caption
+	}
+
+	var text string
+	database.DB.QueryRow(
+		"SELECT COALESCE(text, '') FROM messages WHERE id = ? AND chat_id = ?",
+		message.ID, message.Chat.ID).Scan(&text)
+
+	return text
+}
+
+func autoTranslate(message *telebot.Message) {
+	language, auto := chatLanguage(message.Chat.ID)
+	if !auto || strings.HasPrefix(message.Text, "!") {
+		return
+	}
+
+	// Links and mentions are Latin whatever the language of the message
+	text := stripEntities(message.Text, message.Entities)
+	if len([]rune(strings.TrimSpace(text))) < registry.Config.Translate.MinLength {
+		return
+	}
+
+	detected := detectLanguage(text)
+	if detected == "" || detected == normalizeLanguage(language) {
+		return
+	}
+
+	if !allowAutoTranslation(message.Chat.ID) {
+		log.Printf("Translate: auto translation in chat %v is rate limited", message.Chat.ID)
+		return
+	}
+
+	call := ai.NewCall(message.Chat.ID, message.Sender.ID, "translate")
+	translation, err := translate(call, message.Text, language)
+	if err != nil {
+		log.Printf("Translate: error translating message %v: %v", message.ID, err)
+		return
+	}
+
+	translation, allowed := moderation.Review(call, "output", translation)
+	if !allowed {
+		return
+	}
+
+	registry.Bot.Send(message.Chat, "🌐 "+translation, &telebot.SendOptions{ReplyTo: message, DisableNotification: true})
+}
+
+// allowAutoTranslation enforces the cooldown and the hourly limit of the chat
+func allowAutoTranslation(chatID int64) bool {
+	config := registry.Config.Translate
+	now := time.Now()
+
+	autoTranslationsMutex.Lock()
+	defer autoTranslationsMutex.Unlock()
+
+	var recent []time.Time
+	for _, t := range autoTranslations[chatID] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) > 0 && now.Sub(recent[len(recent)-1]) < config.Cooldown {
+		autoTranslations[chatID] = recent
+		return false
+	}
+	if len(recent) >= config.MaxPerHour {
+		autoTranslations[chatID] = recent
+		return false
+	}
+
+	autoTranslations[chatID] = append(recent, now)
+	return true
+}
+
+func translate(call ai.Call, text string, language string) (string, error) {
+	name := language
+	if full, ok := languageNames[strings.ToLower(language)]; ok {
+		name = full
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	translation, err := ai.Ask(ctx, call,
+		"You are a translator. Translate the user's message into "+name+". "+
+			"Keep the tone, slang, emoji and formatting. Reply with the translation only, without comments.",
+		text)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(translation), nil
+}
+
+// stripEntities removes links, mentions, hashtags and commands from the text
+func stripEntities(text string, entities []telebot.MessageEntity) string {
+	// Entity offsets count UTF-16 code units
+	encoded := utf16.Encode([]rune(text))
+	keep := make([]bool, len(encoded))
+	for i := range keep {
+		keep[i] = true
+	}
+
+	for _, entity := range entities {
+		switch entity.Type {
+		case telebot.EntityURL, telebot.EntityEmail, telebot.EntityMention,
+			telebot.EntityHashtag, telebot.EntityCommand:
+		default:
+			continue
+		}
+
+		if entity.Offset < 0 || entity.Offset+entity.Length > len(encoded) {
+			continue
+		}
+		for i := entity.Offset; i < entity.Offset+entity.Length; i++ {
+			keep[i] = false
+		}
+	}
+
+	stripped := make([]uint16, 0, len(encoded))
+	for i, unit := range encoded {
+		if keep[i] {
+			stripped = append(stripped, unit)
+		}
+	}
+
+	return string(utf16.Decode(stripped))
+}
+
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(language)
+
+	switch language {
+	case "ua", "ukrainian":
+		return "uk"
+	case "russian":
+		return "ru"
+	case "english":
+		return "en"
+	}
+
+	return language
+}
+
+// detectLanguage tells Russian, Ukrainian and English apart by their letters,
+// returns an empty string when unsure
+func detectLanguage(text string) string {
+	var cyrillic, latin, ukrainian, russian int
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case strings.ContainsRune("іїєґ", r):
+			ukrainian++
+			cyrillic++
+		case strings.ContainsRune("ыэъё", r):
+			russian++
+			cyrillic++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case r >= 'a' && r <= 'z':
+			latin++
+		}
+	}
+
+	letters := cyrillic + latin
+	if letters < 10 {
+		return ""
+	}
+
+	switch {
+	case latin*10 >= letters*8:
+		return "en"
+	case cyrillic*10 >= letters*8:
+		if ukrainian > russian {
+			return "uk"
+		}
+		return "ru"
+	}
+
+	return ""
+}
@@ -7,12 +7,14 @@ import (
 	"math/rand"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nicklaw5/helix"
 	"github.com/tucnak/telebot"
 
 	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/markup"
 	"github.com/focusshifter/muxgoob/registry"
 )
 
@@ -23,8 +25,18 @@ var rng *rand.Rand
 var twitchClient *helix.Client
 var twitchTokenRefreshTime time.Time
 
+// liveUsers holds lowercased logins that were live during the last check
+var liveUsers = map[string]bool{}
+var liveUsersMutex sync.Mutex
+
 func init() {
 	registry.RegisterPlugin(&TwitchstreamsPlugin{})
+	registry.RegisterTool(registry.Tool{
+		Name:        "live_streams",
+		Description: "Check which Twitch streamers followed by the current chat are live right now and what they are playing.",
+		Parameters:  registry.NoArguments(),
+		Handler:     liveStreamsTool,
+	})
 }
 
 func (p *TwitchstreamsPlugin) Start(interface{}) {
@@ -99,6 +111,16 @@ func checkStreams(t time.Time) {
 
 	streams := streamResponse.Data.Streams
 
+	live := make(map[string]bool)
+	for _, stream := range streams {
+		if stream.Type == "live" {
+			live[strings.ToLower(stream.UserName)] = true
+		}
+	}
+	liveUsersMutex.Lock()
+	liveUsers = live
+	liveUsersMutex.Unlock()
+
 	for _, stream := range streams {
 		if stream.UserName == "" || stream.Type != "live" {
 			continue
@@ -152,11 +174,11 @@ func checkStreams(t time.Time) {
 		game := getGame(stream.GameID)
 
 		messageText := fmt.Sprintf(
-			"*%s is playing %s*\nhttps://www.twitch.tv/%s\n%s",
-			stream.UserName,
-			game.Name,
-			stream.UserName,
-			stream.Title)
+			"<b>%s is playing %s</b>\nhttps://www.twitch.tv/%s\n%s",
+			markup.Escape(stream.UserName),
+			markup.Escape(game.Name),
+			markup.Escape(stream.UserName),
+			markup.Escape(stream.Title))
 
 		// Send to chats that are configured for this streamer
 		for _, config := range registry.Config.TwitchStreams {
@@ -164,7 +186,7 @@ func checkStreams(t time.Time) {
 				if strings.ToLower(username) == strings.ToLower(stream.UserName) {
 					chat := &telebot.Chat{ID: config.ChatID}
 					bot.Send(chat, messageText, &telebot.SendOptions{
-						ParseMode: "markdown",
+						ParseMode: telebot.ModeHTML,
 					})
 					break
 				}
@@ -213,6 +235,51 @@ func getGame(gameID string) helix.Game {
 	return game
 }
 
+func liveStreamsTool(chatID int64, arguments string) (string, error) {
+	var result string
+
+	for _, config := range registry.Config.TwitchStreams {
+		if config.ChatID != chatID {
+			continue
+		}
+
+		for _, username := range config.TwitchUsernames {
+			liveUsersMutex.Lock()
+			isLive := liveUsers[strings.ToLower(username)]
+			liveUsersMutex.Unlock()
+
+			var startedAt, streamData string
+			err := database.DB.QueryRow(
+				"SELECT started_at, data FROM helix_streams WHERE lower(user_name) = lower(?)",
+				username).Scan(&startedAt, &streamData)
+
+			var stream helix.Stream
+			if err == nil {
+				json.Unmarshal([]byte(streamData), &stream)
+			}
+
+			switch {
+			case isLive && err == nil:
+				result += fmt.Sprintf("%s is live since %s playing %s: %s\n",
+					username, stream.StartedAt.In(registry.Config.TimeLoc).Format("15:04"), getGame(stream.GameID).Name, stream.Title)
+			case isLive:
+				result += fmt.Sprintf("%s is live\n", username)
+			case err == nil:
+				result += fmt.Sprintf("%s is offline, last stream started %s\n",
+					username, stream.StartedAt.In(registry.Config.TimeLoc).Format("02.01.2006 15:04"))
+			default:
+				result += fmt.Sprintf("%s is offline\n", username)
+			}
+		}
+	}
+
+	if result == "" {
+		return "This chat doesn't follow any Twitch streamers", nil
+	}
+
+	return result, nil
+}
+
 func doEvery(d time.Duration, f func(time.Time)) {
 	for x := range time.Tick(d) {
 		f(x)
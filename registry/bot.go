@@ -4,9 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/focusshifter/muxgoob/database"
+	"github.com/focusshifter/muxgoob/markup"
 	"github.com/tucnak/telebot"
 )
 
@@ -86,6 +93,113 @@ func (b *BotWrapper) Send(to telebot.Recipient, what interface{}, options ...int
 	return msg, err
 }
 
+// SendFormatted sends Markdown text as HTML, splitting it into several messages
+// when it's too long. Chunks Telegram fails to parse are sent as plain text.
+// Only the first chunk replies to options.ReplyTo.
+func (b *BotWrapper) SendFormatted(to telebot.Recipient, text string, options *telebot.SendOptions) (*telebot.Message, error) {
+	if options == nil {
+		options = &telebot.SendOptions{}
+	}
+
+	var first *telebot.Message
+	for i, chunk := range markup.Split(text, markup.MaxMessageLength) {
+		chunkOptions := *options
+		chunkOptions.ParseMode = telebot.ModeHTML
+		if i > 0 {
+			chunkOptions.ReplyTo = nil
+		}
+
+		msg, err := b.Send(to, markup.ToHTML(chunk), &chunkOptions)
+		if err != nil {
+			log.Printf("Error sending formatted message, falling back to plain text: %v", err)
+
+			chunkOptions.ParseMode = telebot.ModeDefault
+			msg, err = b.Send(to, chunk, &chunkOptions)
+			if err != nil {
+				return first, err
+			}
+		}
+
+		if first == nil {
+			first = msg
+		}
+	}
+
+	return first, nil
+}
+
+// IsAdmin reports whether the user may manage the bot in the chat:
+// the owner, chat administrators and anyone in a private chat
+func (b *BotWrapper) IsAdmin(chat *telebot.Chat, user *telebot.User) bool {
+	if user.Username != "" && user.Username == Config.OwnerUsername {
+		return true
+	}
+
+	if chat.Type == telebot.ChatPrivate {
+		return true
+	}
+
+	admins, err := b.Bot.AdminsOf(chat)
+	if err != nil {
+		log.Printf("Error getting admins of chat %v: %v", chat.ID, err)
+		return false
+	}
+
+	for _, admin := range admins {
+		if admin.User != nil && admin.User.ID == user.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxDownloadSize is the largest file the Bot API lets bots download
+const maxDownloadSize = 20 * 1024 * 1024
+
+// downloadClient gives up on downloads that stall instead of holding
+// the handler forever
+var downloadClient = &http.Client{Timeout: time.Minute}
+
+// withoutURL drops the request URL from HTTP errors, Bot API URLs
+// contain the token and the errors end up in the log
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// DownloadFile fetches the contents of a file sent to the bot
+func (b *BotWrapper) DownloadFile(fileID string) ([]byte, error) {
+	file, err := b.Bot.FileByID(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("looking up file %v: %w", fileID, withoutURL(err))
+	}
+
+	baseURL := Config.TelegramFileURL
+	if baseURL == "" {
+		baseURL = "https://api.telegram.org/file/bot"
+	}
+
+	resp, err := downloadClient.Get(baseURL + b.Token + "/" + file.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %v: %w", file.FilePath, withoutURL(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %v: %v", file.FilePath, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadSize))
+	if err != nil {
+		return nil, fmt.Errorf("downloading %v: %w", file.FilePath, withoutURL(err))
+	}
+	return data, nil
+}
+
 // Helper functions copied from main.go
 func getMessageID(msg *telebot.Message) interface{} {
 	if msg == nil {
@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tucnak/telebot"
+)
+
+// telegramStub serves getFile and the file contents, the Bot API
+// requests telebot sends to api.telegram.org are routed to it
+func telegramStub(t *testing.T, files map[string][]byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/botTOKEN/getFile":
+			w.Write([]byte(`{"ok": true, "result": {"file_id": "photo", "file_path": "photos/file_1.png"}}`))
+		case "/file/botTOKEN/photos/file_1.png":
+			if data, ok := files["photos/file_1.png"]; ok {
+				w.Write(data)
+				return
+			}
+			http.NotFound(w, r)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+
+	target, _ := url.Parse(server.URL)
+	transport := http.DefaultTransport
+	http.DefaultTransport = roundTripper(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "api.telegram.org" {
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+		}
+		return transport.RoundTrip(r)
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		server.Close()
+	})
+
+	return server
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestDownloadFile(t *testing.T) {
+	image := []byte("\x89PNG\r\n\x1a\nfake image")
+	files := map[string][]byte{"photos/file_1.png": image}
+	server := telegramStub(t, files)
+
+	Config.TelegramFileURL = server.URL + "/file/bot"
+	defer func() { Config.TelegramFileURL = "" }()
+
+	bot := &BotWrapper{Bot: &telebot.Bot{Token: "TOKEN"}}
+
+	data, err := bot.DownloadFile("photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image) {
+		t.Errorf("got %q, want %q", data, image)
+	}
+
+	delete(files, "photos/file_1.png")
+	if _, err := bot.DownloadFile("photo"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	// Transport errors must not carry the token into the log
+	Config.TelegramFileURL = "http://127.0.0.1:1/file/bot"
+	_, err = bot.DownloadFile("photo")
+	if err == nil || strings.Contains(err.Error(), "TOKEN") {
+		t.Errorf("got error %v, want one without the token", err)
+	}
+}
@@ -0,0 +1,18 @@
+package registry
+
+import "log"
+
+// Generator produces text without calling the AI provider, userID is zero
+// when the text should be in the style of the whole chat
+type Generator func(chatID int64, userID int) string
+
+// Generators contains the generators registered by plugins,
+// reply rules can use them by name as an action
+var Generators = map[string]Generator{}
+
+// RegisterGenerator makes the generator available under the given name
+func RegisterGenerator(name string, generator Generator) {
+	log.Printf("Registered generator: %v", name)
+
+	Generators[name] = generator
+}
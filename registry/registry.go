@@ -37,8 +37,38 @@ type NametriggerPluginConfig struct {
 
 // Configuration stores a struct loaded from config.yml
 type BirthdayConfig struct {
-	ChatID int64             `yaml:"chat_id"`
-	Users  map[string]string `yaml:"users"`
+	ChatID      int64             `yaml:"chat_id"`
+	Users       map[string]string `yaml:"users"`
+	Time        string            `yaml:"time"`         // overrides birthday_time
+	TimeZone    string            `yaml:"time_zone"`    // overrides time_zone
+	Reminders   []int             `yaml:"reminders"`    // overrides birthday_reminders
+	RemindersTo string            `yaml:"reminders_to"` // chat or private
+	Greetings   []string          `yaml:"greetings"`    // HTML templates, one is picked at random
+	AiGreeting  bool              `yaml:"ai_greeting"`
+	Stickers    []string          `yaml:"stickers"`   // file IDs
+	Animations  []string          `yaml:"animations"` // GIF file IDs or URLs
+}
+
+// DupeRuleConfig canonicalizes links so the same page posted differently is still a dupe
+type DupeRuleConfig struct {
+	Hosts       []string            `yaml:"hosts"`        // also matches subdomains, empty matches every link
+	Path        string              `yaml:"path"`         // optional regexp the path has to match
+	Host        string              `yaml:"host"`         // replaces the host
+	Rewrites    []DupeRewriteConfig `yaml:"rewrites"`     // may add query parameters with ?
+	StripParams []string            `yaml:"strip_params"` // utm_* matches by prefix, * drops all
+	KeepParams  []string            `yaml:"keep_params"`  // drops all the others
+}
+
+// DupeImagesConfig enables reposted photo detection
+type DupeImagesConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	Threshold     *int `yaml:"threshold"`      // differing bits out of 64 still counted as the same image, 0 means exact
+	MaxCandidates int  `yaml:"max_candidates"` // latest photos of the chat compared with a new one
+}
+
+type DupeRewriteConfig struct {
+	Pattern string `yaml:"pattern"`
+	Replace string `yaml:"replace"`
 }
 
 type TwitchStreamConfig struct {
@@ -49,29 +79,202 @@ type TwitchStreamConfig struct {
 type ChatGptConfigPerChat struct {
 	ChatID       int64  `yaml:"chat_id"`
 	SystemPrompt string `yaml:"system_prompt"`
+	Persona      string `yaml:"persona"` // used until an admin picks another one
+}
+
+// PersonaConfig is a named set of AI settings. Prompts are text/template
+// strings with .ChatTitle, .SenderName, .Date, .Language and .Question;
+// empty fields fall back to the chat_gpt_* settings
+type PersonaConfig struct {
+	Description  string   `yaml:"description"`
+	SystemPrompt string   `yaml:"system_prompt"`
+	UserPrompt   string   `yaml:"user_prompt"`
+	Model        string   `yaml:"model"`
+	Temperature  *float32 `yaml:"temperature"` // nil means the default, 0 is allowed
+	Language     string   `yaml:"language"`
+	HistoryDepth int      `yaml:"history_depth"`
+}
+
+// ReplyRule describes a single trigger of the reply plugin
+type ReplyRule struct {
+	Name        string        `yaml:"name"`
+	Pattern     string        `yaml:"pattern"`
+	Match       string        `yaml:"match"`  // regex (default), contains, prefix, suffix, exact
+	Chance      int           `yaml:"chance"` // fires once in N matches, 0 or 1 means always
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MinLength   int           `yaml:"min_length"`
+	Action      string        `yaml:"action"` // reply (default), ask_ai, sticker
+	Replies     []string      `yaml:"replies"`
+	MissReplies []string      `yaml:"miss_replies"` // sent when the chance roll fails
+	RareReplies []string      `yaml:"rare_replies"` // replace the reply once in RareChance times
+	RareChance  int           `yaml:"rare_chance"`
+	Stickers    []string      `yaml:"stickers"`
+	ReplyTo     bool          `yaml:"reply_to"`
+	ChatIDs     []int64       `yaml:"chat_ids"`
+}
+
+type DigestConfig struct {
+	ChatID int64  `yaml:"chat_id"`
+	Time   string `yaml:"time"` // local time in time_zone, e.g. "09:00"
+}
+
+type SummaryConfig struct {
+	DefaultMessages int            `yaml:"default_messages"`
+	MaxMessages     int            `yaml:"max_messages"`
+	MaxHours        int            `yaml:"max_hours"`
+	ChunkSize       int            `yaml:"chunk_size"` // bytes of chat log per request
+	Language        string         `yaml:"language"`
+	Digests         []DigestConfig `yaml:"digests"`
+}
+
+type SemanticMemoryConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Model         string        `yaml:"model"`
+	BaseURL       string        `yaml:"base_url"` // OpenAI-compatible embeddings endpoint
+	ApiKey        string        `yaml:"api_key"`
+	TopK          int           `yaml:"top_k"`
+	MinScore      float32       `yaml:"min_score"`
+	MinLength     int           `yaml:"min_length"` // shorter messages are not indexed
+	BatchSize     int           `yaml:"batch_size"`
+	IndexInterval time.Duration `yaml:"index_interval"`
+	MaxCandidates int           `yaml:"max_candidates"` // latest indexed messages searched per question
+}
+
+// AiPrice is the price of a model in USD per million tokens,
+// or per minute of audio for transcription models
+type AiPrice struct {
+	Prompt     float64 `yaml:"prompt"`
+	Completion float64 `yaml:"completion"`
+	Minute     float64 `yaml:"minute"`
+}
+
+// AiChatBudget overrides the budgets of a single chat, in USD
+type AiChatBudget struct {
+	ChatID  int64   `yaml:"chat_id"`
+	Daily   float64 `yaml:"daily"`
+	Monthly float64 `yaml:"monthly"`
+}
+
+// AiBudgetConfig limits AI spending, zero means unlimited
+type AiBudgetConfig struct {
+	ChatDaily           float64        `yaml:"chat_daily"`
+	ChatMonthly         float64        `yaml:"chat_monthly"`
+	UserDaily           float64        `yaml:"user_daily"`
+	UserMonthly         float64        `yaml:"user_monthly"`
+	UserRequestsPerHour int            `yaml:"user_requests_per_hour"`
+	Chats               []AiChatBudget `yaml:"chats"`
+	Refusal             string         `yaml:"refusal"`
+}
+
+// TranscriptionChat sets how voice messages of a chat are handled:
+// "reply" posts the transcript, "store" only saves it
+type TranscriptionChat struct {
+	ChatID int64  `yaml:"chat_id"`
+	Mode   string `yaml:"mode"`
+}
+
+type TranscriptionConfig struct {
+	Enabled     bool                `yaml:"enabled"`
+	BaseURL     string              `yaml:"base_url"` // OpenAI-compatible or local whisper server
+	ApiKey      string              `yaml:"api_key"`
+	Model       string              `yaml:"model"`
+	Language    string              `yaml:"language"`
+	MaxDuration int                 `yaml:"max_duration"` // seconds, longer recordings are skipped
+	Chats       []TranscriptionChat `yaml:"chats"`
+}
+
+// UserMemoryConfig controls facts the assistant remembers about members
+type UserMemoryConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Pattern     string `yaml:"pattern"` // regex, the fact is the "fact" group or the last group
+	MaxPerUser  int    `yaml:"max_per_user"`
+	MaxLength   int    `yaml:"max_length"`
+	MaxInjected int    `yaml:"max_injected"`
+}
+
+// TranslateChat enables translation settings for a single chat
+type TranslateChat struct {
+	ChatID   int64  `yaml:"chat_id"`
+	Language string `yaml:"language"` // primary language of the chat, ru, uk, en or a name
+	Auto     bool   `yaml:"auto"`     // translate messages in other languages automatically
+}
+
+type TranslateConfig struct {
+	DefaultLanguage string          `yaml:"default_language"`
+	MinLength       int             `yaml:"min_length"` // shorter messages are not auto-translated
+	Cooldown        time.Duration   `yaml:"cooldown"`   // between auto translations in a chat
+	MaxPerHour      int             `yaml:"max_per_hour"`
+	Chats           []TranslateChat `yaml:"chats"`
+}
+
+// AiCacheConfig controls caching of identical AI questions
+type AiCacheConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+}
+
+// ModerationConfig sets up the checks applied to AI input and output.
+// Actions are block, redact or log.
+type ModerationConfig struct {
+	Enabled      bool              `yaml:"enabled"`
+	Checks       []string          `yaml:"checks"` // openai, blocklist, max_length
+	Action       string            `yaml:"action"`
+	Actions      map[string]string `yaml:"actions"` // per check overrides
+	Blocklist    []string          `yaml:"blocklist"`
+	MaxLength    int               `yaml:"max_length"`
+	BaseURL      string            `yaml:"base_url"` // OpenAI-compatible moderation endpoint
+	ApiKey       string            `yaml:"api_key"`
+	Model        string            `yaml:"model"`
+	BlockedReply string            `yaml:"blocked_reply"`
+}
+
+type MarkovConfig struct {
+	MaxWords      int           `yaml:"max_words"`
+	TrainInterval time.Duration `yaml:"train_interval"`
 }
 
 type Configuration struct {
 	TelegramKey          string                  `yaml:"telegram_key"`
+	TelegramFileURL      string                  `yaml:"telegram_file_url"`
 	ReplyTechLink        string                  `yaml:"reply_tech_link"`
+	ReplyRules           []ReplyRule             `yaml:"reply_rules"`
 	NametriggerConfig    NametriggerPluginConfig `yaml:"nametrigger"`
 	Birthdays            []BirthdayConfig        `yaml:"birthdays"`
+	BirthdayTime         string                  `yaml:"birthday_time"`
+	BirthdayReminders    []int                   `yaml:"birthday_reminders"`
 	TimeZone             string                  `yaml:"time_zone"`
 	TimeLoc              *time.Location
-	DupeIgnoredDomains   []string               `yaml:"dupe_ignored_domains"`
-	TwitchAPIKey         string                 `yaml:"twitch_api_key"`
-	TwitchAPISecret      string                 `yaml:"twitch_api_secret"`
-	TwitchStreams        []TwitchStreamConfig   `yaml:"twitch_streams"`
-	OpenaiApiKey         string                 `yaml:"openai_api_key"`
-	ChatGptUseHistory    bool                   `yaml:"chat_gpt_use_history"`
-	ChatGptSystemPrompt  string                 `yaml:"chat_gpt_system_prompt"`
-	ChatGptConfigPerChat []ChatGptConfigPerChat `yaml:"chat_gpt_config_per_chat"`
-	ChatGptUserPrompt    string                 `yaml:"chat_gpt_user_prompt"`
-	ChatGptHistoryDepth  int                    `yaml:"chat_gpt_history_depth"`
-	OpenrouterApiKey     string                 `yaml:"openrouter_api_key"`
-	OwnerUsername        string                 `yaml:"owner_username"`
-	AiProvider           string                 `yaml:"ai_provider"`
-	AiModel              string                 `yaml:"ai_model"`
+	DupeIgnoredDomains   []string                 `yaml:"dupe_ignored_domains"`
+	DupeRules            []DupeRuleConfig         `yaml:"dupe_rules"`
+	DupeImages           DupeImagesConfig         `yaml:"dupe_images"`
+	TwitchAPIKey         string                   `yaml:"twitch_api_key"`
+	TwitchAPISecret      string                   `yaml:"twitch_api_secret"`
+	TwitchStreams        []TwitchStreamConfig     `yaml:"twitch_streams"`
+	OpenaiApiKey         string                   `yaml:"openai_api_key"`
+	ChatGptUseHistory    bool                     `yaml:"chat_gpt_use_history"`
+	ChatGptSystemPrompt  string                   `yaml:"chat_gpt_system_prompt"`
+	ChatGptConfigPerChat []ChatGptConfigPerChat   `yaml:"chat_gpt_config_per_chat"`
+	ChatGptUserPrompt    string                   `yaml:"chat_gpt_user_prompt"`
+	ChatGptHistoryDepth  int                      `yaml:"chat_gpt_history_depth"`
+	Personas             map[string]PersonaConfig `yaml:"personas"`
+	UserMemory           UserMemoryConfig         `yaml:"user_memory"`
+	Translate            TranslateConfig          `yaml:"translate"`
+	Markov               MarkovConfig             `yaml:"markov"`
+	OpenrouterApiKey     string                   `yaml:"openrouter_api_key"`
+	OwnerUsername        string                   `yaml:"owner_username"`
+	AiProvider           string                   `yaml:"ai_provider"`
+	AiModel              string                   `yaml:"ai_model"`
+	AiBaseURL            string                   `yaml:"ai_base_url"`
+	AiUseTools           bool                     `yaml:"ai_use_tools"`
+	AiVisionModels       []string                 `yaml:"ai_vision_models"`
+	AiMaxToolRounds      int                      `yaml:"ai_max_tool_rounds"`
+	AiPrices             map[string]AiPrice       `yaml:"ai_prices"`
+	AiBudgets            AiBudgetConfig           `yaml:"ai_budgets"`
+	AiCache              AiCacheConfig            `yaml:"ai_cache"`
+	Moderation           ModerationConfig         `yaml:"moderation"`
+	SemanticMemory       SemanticMemoryConfig     `yaml:"semantic_memory"`
+	Summary              SummaryConfig            `yaml:"summary"`
+	Transcription        TranscriptionConfig      `yaml:"transcription"`
 }
 
 // LoadConfig reads configuration into registry.Config
@@ -0,0 +1,45 @@
+package registry
+
+import (
+	"log"
+	"sort"
+)
+
+// Tool is a function the AI assistant can call to look up bot data
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is a JSON schema object describing the arguments
+	Parameters map[string]interface{}
+	// Handler receives the chat the question came from and the raw JSON arguments
+	Handler func(chatID int64, arguments string) (string, error)
+}
+
+// Tools contains the tools registered by plugins
+var Tools = map[string]Tool{}
+
+// RegisterTool makes the tool available to the AI assistant
+func RegisterTool(tool Tool) {
+	log.Printf("Registered tool: %v", tool.Name)
+
+	Tools[tool.Name] = tool
+}
+
+// ToolNames returns the names of the registered tools in a stable order
+func ToolNames() []string {
+	names := make([]string, 0, len(Tools))
+	for name := range Tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NoArguments is the parameter schema of tools that take no arguments
+func NoArguments() map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{},
+	}
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/focusshifter/muxgoob/database"
+)
+
+// JobFn is called once for every local day the job is due
+type JobFn func(day time.Time) error
+
+const dateLayout = "2006-01-02"
+
+// maxCatchUp limits how many missed days are run after a long downtime
+const maxCatchUp = 7
+
+// retryDelay is how long a failed job waits before the next attempt
+const retryDelay = 15 * time.Minute
+
+// Daily runs fn every day at the given "15:04" local time in loc.
+// The date of the last successful run is persisted under name,
+// so restarts neither repeat a day nor skip the days that were missed.
+// A new job starts from its next fire time.
+func Daily(name string, at string, loc *time.Location, fn JobFn) {
+	daily(name, at, loc, fn, false)
+}
+
+// DailyFromToday is Daily for jobs that keep track of what they already did:
+// a new job started after the fire time also runs for today
+func DailyFromToday(name string, at string, loc *time.Location, fn JobFn) {
+	daily(name, at, loc, fn, true)
+}
+
+func daily(name string, at string, loc *time.Location, fn JobFn, fromToday bool) {
+	clock, err := time.Parse("15:04", at)
+	if err != nil {
+		log.Printf("Scheduler: bad time %q for job %v: %v", at, name, err)
+		return
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	log.Printf("Scheduler: job %v runs daily at %v %v", name, at, loc)
+
+	// A new job doesn't catch up on the days before it existed
+	now := time.Now().In(loc)
+	seed := dueDay(clock, now)
+	if fromToday {
+		seed = time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, loc)
+	}
+	if err := seedLastRun(name, seed); err != nil {
+		log.Printf("Scheduler: error seeding job %v: %v", name, err)
+	}
+
+	go func() {
+		var nextAttempt time.Time
+
+		for now := range tick(time.Minute) {
+			if now.Before(nextAttempt) {
+				continue
+			}
+
+			if err := runDue(name, clock, now.In(loc), fn); err != nil {
+				log.Printf("Scheduler: job %v failed: %v", name, err)
+				nextAttempt = now.Add(retryDelay)
+			}
+		}
+	}()
+}
+
+// tick fires immediately and then every d
+func tick(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time)
+
+	go func() {
+		c <- time.Now()
+		for t := range time.Tick(d) {
+			c <- t
+		}
+	}()
+
+	return c
+}
+
+// dueDay returns the latest day whose fire time has passed
+func dueDay(clock time.Time, now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	fireAt := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+
+	if now.Before(fireAt) {
+		return today.AddDate(0, 0, -1)
+	}
+
+	return today
+}
+
+func runDue(name string, clock time.Time, now time.Time, fn JobFn) error {
+	due := dueDay(clock, now)
+
+	lastRun, err := loadLastRun(name, now.Location())
+	if err != nil {
+		return err
+	}
+
+	day := due
+	if !lastRun.IsZero() {
+		if !lastRun.Before(due) {
+			return nil
+		}
+		day = lastRun.AddDate(0, 0, 1)
+	}
+
+	if earliest := due.AddDate(0, 0, -maxCatchUp+1); day.Before(earliest) {
+		log.Printf("Scheduler: job %v skips days before %v", name, earliest.Format(dateLayout))
+		day = earliest
+	}
+
+	for ; !day.After(due); day = day.AddDate(0, 0, 1) {
+		log.Printf("Scheduler: running job %v for %v", name, day.Format(dateLayout))
+
+		if err := fn(day); err != nil {
+			return err
+		}
+
+		if err := setLastRun(name, day); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadLastRun returns the last day the job ran successfully, zero time if it never did
+func loadLastRun(name string, loc *time.Location) (time.Time, error) {
+	var lastRun string
+
+	err := database.DB.QueryRow(
+		"SELECT last_run FROM scheduled_jobs WHERE name = ?",
+		name).Scan(&lastRun)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.ParseInLocation(dateLayout, lastRun, loc)
+}
+
+// seedLastRun marks the day as done unless the job already has a last run
+func seedLastRun(name string, day time.Time) error {
+	_, err := database.DB.Exec(
+		"INSERT OR IGNORE INTO scheduled_jobs (name, last_run) VALUES (?, ?)",
+		name, day.Format(dateLayout))
+
+	return err
+}
+
+func setLastRun(name string, day time.Time) error {
+	_, err := database.DB.Exec(
+		"INSERT OR REPLACE INTO scheduled_jobs (name, last_run) VALUES (?, ?)",
+		name, day.Format(dateLayout))
+
+	return err
+}